@@ -0,0 +1,526 @@
+package gorbac
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Actions that are only recorded in the audit log: ActionReset for Reset and
+// ResetAssignments, ActionReorder and ActionRebuild for Reorder and Rebuild of
+// either tree, and ActionLimit for Roles.SetMaxMembers.
+const (
+	ActionReset   ChangeAction = "reset"
+	ActionReorder ChangeAction = "reorder"
+	ActionRebuild ChangeAction = "rebuild"
+	ActionLimit   ChangeAction = "limit"
+)
+
+// Kinds that are only recorded in the audit log, for prerequisites and
+// separation of duty constraints.
+const (
+	KindPrerequisite ChangeKind = "prerequisite"
+	KindSSD          ChangeKind = "ssd"
+	KindDSD          ChangeKind = "dsd"
+)
+
+// AuditEntry is a single recorded mutation. RoleID, PermissionID and Owner
+// are the affected objects, and are empty when not applicable. Before and
+// After hold JSON describing the affected object around the change.
+// Hash chains the entry to the one before it, whose hash is PrevHash.
+type AuditEntry struct {
+	ID           int64
+	Actor        string
+	Time         time.Time
+	Kind         ChangeKind
+	Action       ChangeAction
+	RoleID       int64
+	PermissionID int64
+	Owner        string
+	Before       json.RawMessage
+	After        json.RawMessage
+	PrevHash     string
+	Hash         string
+}
+
+const auditColumns = "ID, actor, created_at, kind, action, role_id, permission_id, owner, before_value, after_value, prev_hash, hash"
+
+// AuditFilter selects audit entries. Zero fields do not filter.
+// Since is inclusive and Until exclusive. AfterID and Limit page through
+// the log in insertion order.
+type AuditFilter struct {
+	Actor        string
+	Kind         ChangeKind
+	Action       ChangeAction
+	RoleID       int64
+	PermissionID int64
+	Owner        Owner
+	Since        time.Time
+	Until        time.Time
+	AfterID      int64
+	Limit        int
+}
+
+// Audit reads the audit log. The log is append-only: entries are written in
+// the same transaction as the change they describe and never updated.
+type Audit struct {
+	rbac *Rbac
+}
+
+type auditRecord struct {
+	roleID       int64
+	permissionID int64
+	owner        Owner
+	before       interface{}
+	after        interface{}
+
+	// skip leaves the change out of the audit log, for changes that
+	// turned out to change nothing.
+	skip bool
+}
+
+// auditAssignment is what the audit log keeps of a grant or owner assignment.
+// Permission is a path or a pattern.
+type auditAssignment struct {
+	Role       string     `json:"role"`
+	Permission string     `json:"permission,omitempty"`
+	Deny       bool       `json:"deny,omitempty"`
+	Condition  Condition  `json:"condition,omitempty"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+}
+
+func (a *auditAssignment) options(options AssignmentOptions) {
+	a.Condition = options.Condition
+	if !options.ValidFrom.IsZero() {
+		from := options.ValidFrom.UTC()
+		a.ValidFrom = &from
+	}
+	if !options.ValidUntil.IsZero() {
+		until := options.ValidUntil.UTC()
+		a.ValidUntil = &until
+	}
+}
+
+// auditResourceGrant is what the audit log keeps of a resource grant. Role
+// is empty for grants made straight to a user.
+type auditResourceGrant struct {
+	Role         string `json:"role,omitempty"`
+	Permission   string `json:"permission"`
+	ResourceType string `json:"resource_type"`
+	ResourceID   string `json:"resource_id"`
+}
+
+// auditEdge is what the audit log keeps of an inheritance edge or a
+// prerequisite: Role inherits from or requires Other.
+type auditEdge struct {
+	Role  string `json:"role"`
+	Other string `json:"other"`
+}
+
+// auditConstraint is what the audit log keeps of an SSD or DSD constraint.
+type auditConstraint struct {
+	Name        string   `json:"name"`
+	Cardinality int      `json:"cardinality"`
+	Roles       []string `json:"roles"`
+}
+
+// auditLimit is what the audit log keeps of a member limit.
+type auditLimit struct {
+	Role       string `json:"role"`
+	MaxMembers int64  `json:"max_members"`
+}
+
+// auditChildren is what the audit log keeps of the order of a node's
+// children.
+type auditChildren struct {
+	Parent   string   `json:"parent"`
+	Children []string `json:"children"`
+}
+
+// auditRebuild is what the audit log keeps of a tree rebuild: the problems
+// Verify found beforehand.
+type auditRebuild struct {
+	Problems []string `json:"problems"`
+}
+
+// auditNodeState is what the audit log keeps of a role or permission.
+type auditNodeState struct {
+	Path        string `json:"path"`
+	Description string `json:"description"`
+}
+
+// Audit returns the audit log reader.
+func (r Rbac) Audit() Audit {
+	return Audit{rbac: &r}
+}
+
+// WithActor returns a copy of r that records actor as the author of every
+// change it makes.
+func (r Rbac) WithActor(actor string) *Rbac {
+	r.actor = actor
+	return r.bind()
+}
+
+// Query returns the entries matching filter in insertion order.
+func (a Audit) Query(filter AuditFilter) ([]AuditEntry, error) {
+	var conditions []string
+	var args []interface{}
+	var where = func(condition string, arg interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+
+	if filter.Actor != "" {
+		where("actor=?", filter.Actor)
+	}
+	if filter.Kind != "" {
+		where("kind=?", filter.Kind)
+	}
+	if filter.Action != "" {
+		where("action=?", filter.Action)
+	}
+	if filter.RoleID != 0 {
+		where("role_id=?", filter.RoleID)
+	}
+	if filter.PermissionID != 0 {
+		where("permission_id=?", filter.PermissionID)
+	}
+	if filter.Owner != nil {
+		where("owner=?", fmt.Sprint(filter.Owner))
+	}
+	if !filter.Since.IsZero() {
+		where("created_at>=?", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		where("created_at<?", filter.Until.UTC())
+	}
+	if filter.AfterID != 0 {
+		where("ID>?", filter.AfterID)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM audit_log", auditColumns)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY ID"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := a.rbac.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func scanAuditEntry(rows *sql.Rows) (AuditEntry, error) {
+	var entry AuditEntry
+	var before, after []byte
+	err := rows.Scan(&entry.ID, &entry.Actor, &entry.Time, &entry.Kind, &entry.Action, &entry.RoleID, &entry.PermissionID, &entry.Owner, &before, &after, &entry.PrevHash, &entry.Hash)
+	if err != nil {
+		return entry, err
+	}
+	if before != nil {
+		entry.Before = json.RawMessage(before)
+	}
+	if after != nil {
+		entry.After = json.RawMessage(after)
+	}
+
+	return entry, nil
+}
+
+// audited runs change in a transaction and records it in the audit log when
+// it succeeds.
+func (r Rbac) audited(kind ChangeKind, action ChangeAction, change func(tx *Rbac, record *auditRecord) error) error {
+	return r.transaction(func(tx *Rbac) error {
+		var record auditRecord
+		if err := change(tx, &record); err != nil {
+			return err
+		}
+		if record.skip {
+			return nil
+		}
+		return tx.record(kind, action, record)
+	})
+}
+
+// auditedNode runs change on a role or permission and records the node's
+// path and description before and after. id is the node before the change,
+// or 0 when change creates it and returns the new ID.
+func (r Rbac) auditedNode(kind ChangeKind, action ChangeAction, id int64, change func(tx *Rbac) (int64, error)) (int64, error) {
+	var resultID int64
+	err := r.audited(kind, action, func(tx *Rbac, record *auditRecord) error {
+		var e = tx.tree(kind)
+
+		var err error
+		if id != 0 {
+			if record.before, err = auditNode(e, id); err != nil {
+				return err
+			}
+		}
+
+		if resultID, err = change(tx); err != nil {
+			return err
+		}
+
+		if action != ActionRemove {
+			if record.after, err = auditNode(e, resultID); err != nil {
+				return err
+			}
+		}
+
+		if kind == KindRole {
+			record.roleID = resultID
+		} else {
+			record.permissionID = resultID
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return resultID, nil
+}
+
+// auditedEdge runs change on an edge between two roles, such as an
+// inheritance edge or a prerequisite, and records both ends. change reports
+// whether it modified anything.
+func (r Rbac) auditedEdge(kind ChangeKind, action ChangeAction, roleID, otherID int64, change func(tx *Rbac) (bool, error)) error {
+	return r.audited(kind, action, func(tx *Rbac, record *auditRecord) error {
+		var state auditEdge
+		var err error
+		if state.Role, err = tx.roles.GetPath(roleID); err != nil {
+			return err
+		}
+		if state.Other, err = tx.roles.GetPath(otherID); err != nil {
+			return err
+		}
+
+		changed, err := change(tx)
+		if err != nil {
+			return err
+		}
+
+		record.roleID, record.skip = roleID, !changed
+		if action == ActionAssign {
+			record.after = state
+		} else {
+			record.before = state
+		}
+		return nil
+	})
+}
+
+// deleteRows runs a DELETE statement and reports whether it deleted a row.
+func (r Rbac) deleteRows(query string, args ...interface{}) (bool, error) {
+	res, err := r.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := res.RowsAffected()
+	return deleted > 0, err
+}
+
+// reorderTree reorders the children of parentID in the role or permission
+// tree and records their order before and after.
+func (r Rbac) reorderTree(kind ChangeKind, parentID int64, ids []int64) error {
+	if parentID == 0 {
+		parentID = r.rootID()
+	}
+
+	return r.audited(kind, ActionReorder, func(tx *Rbac, record *auditRecord) error {
+		var e = tx.tree(kind)
+
+		before, err := auditOrder(e, parentID)
+		if err != nil {
+			return err
+		}
+
+		if err := e.reorder(parentID, ids); err != nil {
+			return err
+		}
+
+		after, err := auditOrder(e, parentID)
+		if err != nil {
+			return err
+		}
+
+		record.before, record.after = before, after
+		record.skip = strings.Join(before.Children, "/") == strings.Join(after.Children, "/")
+		if kind == KindRole {
+			record.roleID = parentID
+		} else {
+			record.permissionID = parentID
+		}
+		return nil
+	})
+}
+
+// rebuildTree rebuilds the role or permission tree and records the problems
+// it repaired. A rebuild of a sound tree is not recorded.
+func (r Rbac) rebuildTree(kind ChangeKind) error {
+	return r.audited(kind, ActionRebuild, func(tx *Rbac, record *auditRecord) error {
+		var e = tx.tree(kind)
+
+		problems, err := e.verify()
+		if err != nil {
+			return err
+		}
+
+		var state = auditRebuild{Problems: []string{}}
+		for _, problem := range problems {
+			state.Problems = append(state.Problems, problem.String())
+		}
+		record.before, record.skip = state, len(problems) == 0
+
+		return e.rebuild()
+	})
+}
+
+func auditOrder(e entityInternal, parentID int64) (auditChildren, error) {
+	var state = auditChildren{Children: []string{}}
+	var err error
+	if state.Parent, err = e.getPath(parentID); err != nil {
+		return state, err
+	}
+
+	children, err := e.children(parentID)
+	if err != nil {
+		return state, err
+	}
+	for _, child := range children {
+		state.Children = append(state.Children, child.Title)
+	}
+
+	return state, nil
+}
+
+// tree returns the role or permission tree.
+func (r Rbac) tree(kind ChangeKind) entityInternal {
+	if kind == KindRole {
+		return r.roles.entity
+	}
+	return r.permissions.entity
+}
+
+func (r Rbac) auditGrant(roleID, permissionID int64, permission PermissionInterface) (auditAssignment, error) {
+	var state auditAssignment
+	var err error
+	if state.Role, err = r.roles.GetPath(roleID); err != nil {
+		return state, err
+	}
+
+	if isPattern(permission) {
+		state.Permission = permission.(string)
+		return state, nil
+	}
+
+	state.Permission, err = r.permissions.GetPath(permissionID)
+	return state, err
+}
+
+// auditResource describes a resource grant; roleID is 0 for a user grant.
+func (r Rbac) auditResource(roleID, permissionID int64, resourceType string, resourceID interface{}) (auditResourceGrant, error) {
+	var state = auditResourceGrant{ResourceType: resourceType, ResourceID: fmt.Sprint(resourceID)}
+	var err error
+	if roleID != 0 {
+		if state.Role, err = r.roles.GetPath(roleID); err != nil {
+			return state, err
+		}
+	}
+
+	state.Permission, err = r.permissions.GetPath(permissionID)
+	return state, err
+}
+
+func (r Rbac) auditRole(roleID int64) (auditAssignment, error) {
+	role, err := r.roles.GetPath(roleID)
+	return auditAssignment{Role: role}, err
+}
+
+// lockAssignment reads the deny flag, condition and validity window of the
+// assignment selected by query into state, and locks it until the
+// transaction ends. It reports false when there is no such assignment.
+func (r Rbac) lockAssignment(state *auditAssignment, query string, args ...interface{}) (bool, error) {
+	var options AssignmentOptions
+	var from, until sql.NullTime
+	err := r.db.QueryRow(query+" LIMIT 1 FOR UPDATE", args...).Scan(&state.Deny, &options.Condition, &from, &until)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	options.ValidFrom, options.ValidUntil = from.Time, until.Time
+	state.options(options)
+	return true, nil
+}
+
+func auditNode(e entityInternal, id int64) (auditNodeState, error) {
+	path, err := e.getPath(id)
+	if err != nil {
+		return auditNodeState{}, err
+	}
+
+	description, err := e.getDescription(id)
+	if err != nil {
+		return auditNodeState{}, err
+	}
+
+	return auditNodeState{Path: path, Description: description}, nil
+}
+
+// record appends an entry to the audit log, chained to the previous one.
+func (r Rbac) record(kind ChangeKind, action ChangeAction, record auditRecord) error {
+	before, err := auditJSON(record.before)
+	if err != nil {
+		return err
+	}
+	after, err := auditJSON(record.after)
+	if err != nil {
+		return err
+	}
+
+	var entry = AuditEntry{
+		Actor:        r.actor,
+		Time:         time.Now().UTC().Truncate(time.Microsecond),
+		Kind:         kind,
+		Action:       action,
+		RoleID:       record.roleID,
+		PermissionID: record.permissionID,
+		Before:       before,
+		After:        after,
+	}
+	if record.owner != nil {
+		entry.Owner = fmt.Sprint(record.owner)
+	}
+
+	return r.chain(entry)
+}
+
+func auditJSON(value interface{}) (json.RawMessage, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	return json.Marshal(value)
+}
@@ -0,0 +1,169 @@
+package gorbac
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrRoleFull          = errors.New("role has reached its maximum number of members")
+	ErrInvalidMaxMembers = errors.New("maximum number of members must not be negative")
+)
+
+// RoleCardinality reports how many owners hold a role directly.
+// MaxMembers is 0 for a role without a limit.
+type RoleCardinality struct {
+	RoleID     int64
+	MaxMembers int64
+	Members    int64
+	Extensions map[string]int64
+}
+
+// SetMaxMembers limits how many owners may be assigned a role, counted over
+// every owner extension. The limit is enforced by Users.Assign and by the
+// Assign method of every extension returned by Rbac.OwnerExtension. Passing 0
+// removes the limit. Owners that already hold the role keep it when the limit
+// is lowered below the current count.
+func (r Roles) SetMaxMembers(role RoleInterface, max int64) error {
+	if max < 0 {
+		return ErrInvalidMaxMembers
+	}
+
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return err
+	}
+
+	return r.rbac.audited(KindRole, ActionLimit, func(tx *Rbac, record *auditRecord) error {
+		role, err := tx.roles.GetPath(roleID)
+		if err != nil {
+			return err
+		}
+
+		var before = auditLimit{Role: role}
+		err = tx.db.QueryRow(fmt.Sprintf("SELECT max_members FROM %s WHERE id=? FOR UPDATE", r.getTable()), roleID).Scan(&before.MaxMembers)
+		if err != nil {
+			return err
+		}
+		if before.MaxMembers == max {
+			record.skip = true
+			return nil
+		}
+		record.roleID, record.before, record.after = roleID, before, auditLimit{Role: role, MaxMembers: max}
+
+		_, err = tx.db.Exec(fmt.Sprintf("UPDATE %s SET max_members=? WHERE id=?", r.getTable()), max, roleID)
+		return err
+	})
+}
+
+// Cardinality reports the member limit of a role and how many owners of each
+// extension hold it. Expired assignments are not counted.
+func (r Roles) Cardinality(role RoleInterface) (RoleCardinality, error) {
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return RoleCardinality{}, err
+	}
+
+	var cardinality = RoleCardinality{RoleID: roleID}
+	err = r.rbac.db.QueryRow(fmt.Sprintf("SELECT max_members FROM %s WHERE id=?", r.getTable()), roleID).Scan(&cardinality.MaxMembers)
+	if err != nil {
+		return RoleCardinality{}, err
+	}
+
+	cardinality.Extensions, cardinality.Members, err = r.rbac.roleMembers(roleID)
+	if err != nil {
+		return RoleCardinality{}, err
+	}
+
+	return cardinality, nil
+}
+
+// reserveMember fails with ErrRoleFull when the role has no room for another
+// member. The role row stays locked until the surrounding transaction ends,
+// so concurrent assignments cannot both take the last place.
+func (r Rbac) reserveMember(roleID int64) error {
+	var max int64
+	err := r.db.QueryRow(fmt.Sprintf("SELECT max_members FROM %s WHERE id=? FOR UPDATE", r.roles.getTable()), roleID).Scan(&max)
+	if err != nil || max == 0 {
+		return err
+	}
+
+	_, members, err := r.roleMembers(roleID)
+	if err != nil {
+		return err
+	}
+	if members >= max {
+		return ErrRoleFull
+	}
+
+	return nil
+}
+
+// limitedOwners enforces member limits for an owner extension that does not
+// check them itself. Assign reserves a place on the role before handing the
+// assignment to the extension, and keeps the role locked until it is done,
+// so it fails with ErrUnboundExtension for extensions that are not
+// BindableOwners.
+type limitedOwners struct {
+	Owners
+	rbac *Rbac
+}
+
+// limitMembers wraps extension in limitedOwners, unless it is the built-in
+// Users, which checks member limits on its own.
+func (r *Rbac) limitMembers(extension Owners) Owners {
+	if _, ok := extension.(Users); extension == nil || ok {
+		return extension
+	}
+	return limitedOwners{Owners: extension, rbac: r}
+}
+
+func (l limitedOwners) Assign(role RoleInterface, owner Owner, meta interface{}) (int64, error) {
+	bindable, ok := l.Owners.(BindableOwners)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrUnboundExtension, l.Table())
+	}
+
+	roleID, err := l.rbac.roles.GetRoleID(role)
+	if err != nil {
+		return 0, err
+	}
+
+	var insertID int64
+	err = l.rbac.transaction(func(tx *Rbac) error {
+		if err := tx.reserveMember(roleID); err != nil {
+			return err
+		}
+
+		insertID, err = bindable.Bind(tx).Assign(role, owner, meta)
+		return err
+	})
+
+	return insertID, err
+}
+
+// roleMembers counts the owners assigned to a role per extension.
+func (r Rbac) roleMembers(roleID int64) (map[string]int64, int64, error) {
+	var total int64
+	var counts = make(map[string]int64, len(r.extensions))
+	for name, extension := range r.extensions {
+		var query = fmt.Sprintf("SELECT COUNT(DISTINCT user_id) FROM %s WHERE role_id=?", extension.Table())
+		var args = []interface{}{roleID}
+
+		// Only the built-in Users store validity windows.
+		if _, ok := extension.(Users); ok {
+			query += " AND (valid_until IS NULL OR valid_until > ?)"
+			args = append(args, time.Now().UTC())
+		}
+
+		var count int64
+		if err := r.db.QueryRow(query, args...).Scan(&count); err != nil {
+			return nil, 0, err
+		}
+		counts[name] = count
+		total += count
+	}
+
+	return counts, total, nil
+}
@@ -0,0 +1,257 @@
+package gorbac
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoAuditKey      = errors.New("no audit signing key configured")
+	ErrEmptyAuditLog   = errors.New("audit log is empty")
+	ErrNoAuditVerifier = errors.New("no audit public key configured")
+)
+
+// Audit chain problems
+const (
+	ProblemEntryHash  ProblemKind = "entry hash mismatch"
+	ProblemChainLink  ProblemKind = "broken chain"
+	ProblemUnchained  ProblemKind = "unchained entry"
+	ProblemChainHead  ProblemKind = "chain head mismatch"
+	ProblemCheckpoint ProblemKind = "checkpoint mismatch"
+	ProblemSignature  ProblemKind = "invalid signature"
+)
+
+// AuditProblem describes a single inconsistency in the audit chain. ID is the
+// audit entry, or the checkpoint for checkpoint problems.
+type AuditProblem struct {
+	Kind   ProblemKind
+	ID     int64
+	Detail string
+}
+
+func (p AuditProblem) String() string {
+	if p.ID == 0 {
+		return fmt.Sprintf("%s: %s", p.Kind, p.Detail)
+	}
+	return fmt.Sprintf("%s (id %d): %s", p.Kind, p.ID, p.Detail)
+}
+
+// AuditCheckpoint is a signed statement that the audit log held EntryID,
+// with chain hash Hash, as its latest entry.
+type AuditCheckpoint struct {
+	ID        int64
+	EntryID   int64
+	Hash      string
+	Signature []byte
+	Time      time.Time
+}
+
+// chainHash returns the SHA-256 hash linking the entry to PrevHash. The ID is
+// left out, as auto increment values are not contiguous.
+func (e AuditEntry) chainHash() string {
+	var value = func(raw json.RawMessage) interface{} {
+		if raw == nil {
+			return nil
+		}
+		return string(raw)
+	}
+
+	data, _ := json.Marshal([]interface{}{
+		e.PrevHash, e.Actor, e.Time.UTC().Format("2006-01-02T15:04:05.000000Z"), e.Kind, e.Action,
+		e.RoleID, e.PermissionID, e.Owner, value(e.Before), value(e.After),
+	})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func checkpointMessage(entryID int64, hash string) []byte {
+	return []byte(fmt.Sprintf("gorbac audit checkpoint %d %s", entryID, hash))
+}
+
+// chain links entry to the head of the audit log, inserts it and moves the
+// head. The head row is locked, so concurrent writers extend the chain one
+// at a time.
+func (r Rbac) chain(entry AuditEntry) error {
+	return r.transaction(func(tx *Rbac) error {
+		err := tx.db.QueryRow("SELECT hash FROM audit_head WHERE ID=1 FOR UPDATE").Scan(&entry.PrevHash)
+		if err != nil {
+			return err
+		}
+		entry.Hash = entry.chainHash()
+
+		var before, after interface{}
+		if entry.Before != nil {
+			before = string(entry.Before)
+		}
+		if entry.After != nil {
+			after = string(entry.After)
+		}
+
+		res, err := tx.db.Exec("INSERT INTO audit_log (actor, created_at, kind, action, role_id, permission_id, owner, before_value, after_value, prev_hash, hash) VALUES(?,?,?,?,?,?,?,?,?,?,?)",
+			entry.Actor, entry.Time, entry.Kind, entry.Action, entry.RoleID, entry.PermissionID, entry.Owner, before, after, entry.PrevHash, entry.Hash)
+		if err != nil {
+			return err
+		}
+
+		entryID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.db.Exec("UPDATE audit_head SET first_entry_id=IF(first_entry_id=0, ?, first_entry_id), entry_id=?, hash=? WHERE ID=1", entryID, entryID, entry.Hash)
+		return err
+	})
+}
+
+// Checkpoint signs the current head of the audit log with Config.AuditKey
+// and stores the signature. A checkpoint lets Verify detect entries removed
+// from the end of the log, and a chain rewritten from scratch.
+func (a Audit) Checkpoint() (AuditCheckpoint, error) {
+	var checkpoint AuditCheckpoint
+	if a.rbac.auditKey == nil {
+		return checkpoint, ErrNoAuditKey
+	}
+
+	err := a.rbac.transaction(func(tx *Rbac) error {
+		err := tx.db.QueryRow("SELECT entry_id, hash FROM audit_head WHERE ID=1 FOR UPDATE").Scan(&checkpoint.EntryID, &checkpoint.Hash)
+		if err != nil {
+			return err
+		}
+		if checkpoint.EntryID == 0 {
+			return ErrEmptyAuditLog
+		}
+
+		checkpoint.Signature = ed25519.Sign(a.rbac.auditKey, checkpointMessage(checkpoint.EntryID, checkpoint.Hash))
+		checkpoint.Time = time.Now().UTC().Truncate(time.Microsecond)
+
+		res, err := tx.db.Exec("INSERT INTO audit_checkpoints (entry_id, hash, signature, created_at) VALUES(?,?,?,?)",
+			checkpoint.EntryID, checkpoint.Hash, hex.EncodeToString(checkpoint.Signature), checkpoint.Time)
+		if err != nil {
+			return err
+		}
+
+		checkpoint.ID, err = res.LastInsertId()
+		return err
+	})
+
+	return checkpoint, err
+}
+
+// Checkpoints returns the stored checkpoints, oldest first.
+func (a Audit) Checkpoints() ([]AuditCheckpoint, error) {
+	rows, err := a.rbac.db.Query("SELECT ID, entry_id, hash, signature, created_at FROM audit_checkpoints ORDER BY ID")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkpoints []AuditCheckpoint
+	for rows.Next() {
+		var checkpoint AuditCheckpoint
+		var signature string
+		if err := rows.Scan(&checkpoint.ID, &checkpoint.EntryID, &checkpoint.Hash, &signature, &checkpoint.Time); err != nil {
+			return nil, err
+		}
+		// An undecodable signature is left empty and fails verification.
+		checkpoint.Signature, _ = hex.DecodeString(signature)
+		checkpoints = append(checkpoints, checkpoint)
+	}
+
+	return checkpoints, rows.Err()
+}
+
+// Verify walks the audit log and returns every sign of tampering: entries
+// whose content no longer matches their hash, links broken by a removed or
+// inserted entry, and checkpoints that do not match the log or carry an
+// invalid signature. Signatures are checked against Config.AuditPublicKey,
+// and Verify fails with ErrNoAuditVerifier when there are checkpoints but no
+// key. Entries recorded before the first chained entry are skipped; any
+// unhashed entry after it is reported.
+func (a Audit) Verify() ([]AuditProblem, error) {
+	checkpoints, err := a.Checkpoints()
+	if err != nil {
+		return nil, err
+	}
+	if len(checkpoints) > 0 && a.rbac.auditPublicKey == nil {
+		return nil, ErrNoAuditVerifier
+	}
+
+	var firstID, headID int64
+	var headHash string
+	err = a.rbac.db.QueryRow("SELECT first_entry_id, entry_id, hash FROM audit_head WHERE ID=1").Scan(&firstID, &headID, &headHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []AuditProblem
+	var signed []AuditCheckpoint
+	var expected = make(map[int64][]AuditCheckpoint)
+	for _, checkpoint := range checkpoints {
+		if !ed25519.Verify(a.rbac.auditPublicKey, checkpointMessage(checkpoint.EntryID, checkpoint.Hash), checkpoint.Signature) {
+			problems = append(problems, AuditProblem{Kind: ProblemSignature, ID: checkpoint.ID, Detail: fmt.Sprintf("checkpoint of entry %d", checkpoint.EntryID)})
+			continue
+		}
+		signed = append(signed, checkpoint)
+		expected[checkpoint.EntryID] = append(expected[checkpoint.EntryID], checkpoint)
+	}
+
+	rows, err := a.rbac.db.Query(fmt.Sprintf("SELECT %s FROM audit_log ORDER BY ID", auditColumns))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prevHash string
+	var lastID int64
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Hash == "" {
+			if firstID != 0 && entry.ID >= firstID {
+				problems = append(problems, AuditProblem{Kind: ProblemUnchained, ID: entry.ID, Detail: "entry has no hash"})
+			}
+			continue
+		}
+
+		if entry.PrevHash != prevHash {
+			problems = append(problems, AuditProblem{Kind: ProblemChainLink, ID: entry.ID, Detail: "previous hash does not match the preceding entry"})
+		}
+		if entry.chainHash() != entry.Hash {
+			problems = append(problems, AuditProblem{Kind: ProblemEntryHash, ID: entry.ID, Detail: "entry was modified after it was recorded"})
+		}
+
+		for _, checkpoint := range expected[entry.ID] {
+			if checkpoint.Hash != entry.Hash {
+				problems = append(problems, AuditProblem{Kind: ProblemCheckpoint, ID: checkpoint.ID, Detail: fmt.Sprintf("entry %d does not match the signed hash", entry.ID)})
+			}
+		}
+		delete(expected, entry.ID)
+
+		prevHash = entry.Hash
+		lastID = entry.ID
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, checkpoint := range signed {
+		if _, missing := expected[checkpoint.EntryID]; missing {
+			problems = append(problems, AuditProblem{Kind: ProblemCheckpoint, ID: checkpoint.ID, Detail: fmt.Sprintf("signed entry %d is missing", checkpoint.EntryID)})
+		}
+	}
+
+	if headID != lastID || headHash != prevHash {
+		problems = append(problems, AuditProblem{Kind: ProblemChainHead, ID: headID, Detail: fmt.Sprintf("head points at entry %d, log ends at entry %d", headID, lastID)})
+	}
+
+	return problems, nil
+}
@@ -0,0 +1,544 @@
+package gorbac
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrUnsupportedHierarchy is returned for operations the selected hierarchy
+// strategy cannot perform.
+var ErrUnsupportedHierarchy = errors.New("operation is not supported by this hierarchy")
+
+// closureEntity stores a tree as parent pointers plus a closure table that
+// holds a row for every ancestor-descendant pair, including every node paired
+// with itself at depth 0. The lft and rght columns are left at 0.
+type closureEntity struct {
+	entity
+	paths string
+}
+
+func newClosureEntity(r *Rbac, holder entityHolder) *closureEntity {
+	return &closureEntity{
+		entity: entity{rbac: r, entityHolder: holder},
+		paths:  strings.TrimSuffix(holder.getTable(), "s") + "_paths",
+	}
+}
+
+func (c closureEntity) add(title, description string, parentID int64) (int64, error) {
+	if parentID == 0 {
+		parentID = c.rbac.rootID()
+	}
+
+	var table = c.entityHolder.getTable()
+	var depth int64
+
+	err := c.rbac.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id=?", Depth, table), parentID).Scan(&depth)
+	if err != nil {
+		return -1, err
+	}
+
+	if err := c.checkTitle(title, parentID, 0); err != nil {
+		return -1, err
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (`%s`, `%s`, `%s`, `%s`, `title`, `description`) VALUES (0,0,?,?,?,?)", table, Left, Right, Parent, Depth)
+	res, err := c.rbac.db.Exec(query, parentID, depth+1, title, description)
+	if err != nil {
+		return -1, err
+	}
+	insertID, _ := res.LastInsertId()
+
+	// One row per ancestor of the parent, plus the node itself.
+	query = fmt.Sprintf("INSERT INTO %s (ancestor_id, descendant_id, depth) SELECT ancestor_id, ?, depth + 1 FROM %s WHERE descendant_id=?", c.paths, c.paths)
+	_, err = c.rbac.db.Exec(query, insertID, parentID)
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = c.rbac.db.Exec(fmt.Sprintf("INSERT INTO %s (ancestor_id, descendant_id, depth) VALUES (?,?,0)", c.paths), insertID, insertID)
+	if err != nil {
+		return -1, err
+	}
+
+	return insertID, nil
+}
+
+func (c closureEntity) addPath(path string, descriptions []string) (int64, error) {
+	return addPath(c, path, descriptions)
+}
+
+func (c closureEntity) getPath(id int64) (string, error) {
+	return getPath(c, id)
+}
+
+func (c closureEntity) returnID(entity string) (int64, error) {
+	return returnID(c, entity)
+}
+
+func (c closureEntity) reset(ensure bool) error {
+	if err := c.entity.reset(ensure); err != nil {
+		return err
+	}
+
+	_, err := c.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s", c.paths))
+	if err != nil {
+		return err
+	}
+
+	_, err = c.rbac.db.Exec(fmt.Sprintf("INSERT INTO %s (ancestor_id, descendant_id, depth) VALUES (?,?,0)", c.paths), c.rbac.rootID(), c.rbac.rootID())
+	return err
+}
+
+// pathID follows the path one level at a time through the parent pointers.
+func (c closureEntity) pathID(path string) (int64, error) {
+	var id = c.rbac.rootID()
+	query := fmt.Sprintf("SELECT id FROM %s WHERE %s=? AND title=? ORDER BY id LIMIT 1", c.entityHolder.getTable(), Parent)
+
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		err := c.rbac.db.QueryRow(query, id, part).Scan(&id)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				return 0, err
+			}
+			return 0, ErrPathNotFound
+		}
+	}
+
+	return id, nil
+}
+
+func (c closureEntity) titleID(title string) (int64, error) {
+	return titleID(c, title)
+}
+
+func (c closureEntity) pathConditional(id int64) ([]Node, error) {
+	query := fmt.Sprintf(`
+		SELECT node.ID, node.Title, node.Description, node.%s
+		FROM %s AS closure
+		JOIN %s AS node ON (node.ID = closure.ancestor_id)
+		WHERE closure.descendant_id=?
+		ORDER BY closure.depth DESC`, Depth, c.paths, c.entityHolder.getTable())
+
+	return c.nodes(query, id)
+}
+
+// leaves has no left and right values to compare, so it looks for nodes
+// without children instead.
+func (c closureEntity) leaves(id int64) ([]Node, error) {
+	var table = c.entityHolder.getTable()
+	query := fmt.Sprintf(`
+		SELECT node.ID, node.Title, node.Description, node.%s
+		FROM %s AS closure
+		JOIN %s AS node ON (node.ID = closure.descendant_id)
+		WHERE closure.ancestor_id=?
+		AND NOT EXISTS (SELECT 1 FROM %s AS child WHERE child.%s = node.ID)
+		ORDER BY node.ID`, Depth, c.paths, table, table, Parent)
+
+	return c.nodes(query, id)
+}
+
+func (c closureEntity) subtreeSize(id int64) (int64, error) {
+	var result int64
+	err := c.rbac.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE ancestor_id=?", c.paths), id).Scan(&result)
+	if err != nil {
+		return 0, err
+	}
+	if result == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	return result, nil
+}
+
+// descendants returns the subtree in depth-first order, like the nested set
+// does, with siblings ordered by ID.
+func (c closureEntity) descendants(absolute bool, id int64) ([]Node, error) {
+	query := fmt.Sprintf(`
+		SELECT node.ID, node.Title, node.Description, node.%s, node.%s, closure.depth
+		FROM %s AS closure
+		JOIN %s AS node ON (node.ID = closure.descendant_id)
+		WHERE closure.ancestor_id=? AND closure.depth > 0
+		ORDER BY node.ID`, Parent, Depth, c.paths, c.entityHolder.getTable())
+
+	rows, err := c.rbac.db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var children = make(map[int64][]Node)
+	for rows.Next() {
+		var p Node
+		var parentID, depth, relative int64
+		if err := rows.Scan(&p.ID, &p.Title, &p.Description, &parentID, &depth, &relative); err != nil {
+			return nil, err
+		}
+		p.Depth = relative
+		if absolute {
+			p.Depth = depth
+		}
+		children[parentID] = append(children[parentID], p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var result []Node
+	var walk func(id int64)
+	walk = func(id int64) {
+		for _, p := range children[id] {
+			result = append(result, p)
+			walk(p.ID)
+		}
+	}
+	walk(id)
+
+	return result, nil
+}
+
+func (c closureEntity) children(id int64) ([]Node, error) {
+	return c.descendants(false, id)
+}
+
+// subtree returns id and all of its descendants.
+func (c closureEntity) subtree(id int64) ([]int64, error) {
+	return c.closureIDs(fmt.Sprintf("SELECT descendant_id FROM %s WHERE ancestor_id=?", c.paths), id)
+}
+
+// ancestors returns all ancestors of id, without id itself.
+func (c closureEntity) ancestors(id int64) ([]int64, error) {
+	return c.closureIDs(fmt.Sprintf("SELECT ancestor_id FROM %s WHERE descendant_id=? AND depth > 0", c.paths), id)
+}
+
+func (c closureEntity) closureIDs(query string, id int64) ([]int64, error) {
+	rows, err := c.rbac.db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func (c closureEntity) deleteConditional(id int64) error {
+	var table = c.entityHolder.getTable()
+
+	var parentID int64
+	err := c.rbac.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id=?", Parent, table), id).Scan(&parentID)
+	if err != nil {
+		return err
+	}
+
+	subtree, err := c.subtree(id)
+	if err != nil {
+		return err
+	}
+	ancestors, err := c.ancestors(id)
+	if err != nil {
+		return err
+	}
+
+	// Descendants move up one level, so every path that ran through id gets shorter.
+	if len(subtree) > 1 && len(ancestors) > 0 {
+		query := fmt.Sprintf("UPDATE %s SET depth = depth - 1 WHERE descendant_id IN (%s) AND ancestor_id IN (%s)", c.paths, placeholders(len(subtree)), placeholders(len(ancestors)))
+		_, err = c.rbac.db.Exec(query, append(int64Args(subtree), int64Args(ancestors)...)...)
+		if err != nil {
+			return err
+		}
+
+		query = fmt.Sprintf("UPDATE %s SET %s = %s - 1 WHERE id IN (%s) AND id <> ?", table, Depth, Depth, placeholders(len(subtree)))
+		_, err = c.rbac.db.Exec(query, append(int64Args(subtree), id)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = c.rbac.db.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", table, Parent, Parent), parentID, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE ancestor_id=? OR descendant_id=?", c.paths), id, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id=?", table), id)
+	return err
+}
+
+func (c closureEntity) deleteSubtreeConditional(id int64) error {
+	subtree, err := c.subtree(id)
+	if err != nil {
+		return err
+	}
+	if len(subtree) == 0 {
+		return nil
+	}
+
+	_, err = c.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE descendant_id IN (%s)", c.paths, placeholders(len(subtree))), int64Args(subtree)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id IN (%s)", c.entityHolder.getTable(), placeholders(len(subtree))), int64Args(subtree)...)
+	return err
+}
+
+func (c closureEntity) move(id int64, parentID int64, title string) error {
+	if parentID == 0 {
+		parentID = c.rbac.rootID()
+	}
+	if id == c.rbac.rootID() {
+		return ErrMoveRoot
+	}
+
+	var table = c.entityHolder.getTable()
+
+	var below int64
+	err := c.rbac.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE ancestor_id=? AND descendant_id=?", c.paths), id, parentID).Scan(&below)
+	if err != nil {
+		return err
+	}
+	if below > 0 {
+		return ErrMoveIntoSelf
+	}
+
+	title, err = c.checkMove(id, parentID, title)
+	if err != nil {
+		return err
+	}
+
+	var depth, parentDepth int64
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id=?", Depth, table)
+	if err := c.rbac.db.QueryRow(query, id).Scan(&depth); err != nil {
+		return err
+	}
+	if err := c.rbac.db.QueryRow(query, parentID).Scan(&parentDepth); err != nil {
+		return err
+	}
+
+	subtree, err := c.subtree(id)
+	if err != nil {
+		return err
+	}
+	ancestors, err := c.ancestors(id)
+	if err != nil {
+		return err
+	}
+
+	// Cut the subtree loose from its old ancestors ...
+	if len(ancestors) > 0 {
+		query = fmt.Sprintf("DELETE FROM %s WHERE descendant_id IN (%s) AND ancestor_id IN (%s)", c.paths, placeholders(len(subtree)), placeholders(len(ancestors)))
+		_, err = c.rbac.db.Exec(query, append(int64Args(subtree), int64Args(ancestors)...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// ... and hang it below every ancestor of the new parent.
+	query = fmt.Sprintf(`
+		INSERT INTO %s (ancestor_id, descendant_id, depth)
+		SELECT super.ancestor_id, sub.descendant_id, super.depth + sub.depth + 1
+		FROM %s AS super, %s AS sub
+		WHERE super.descendant_id=? AND sub.ancestor_id=?`, c.paths, c.paths, c.paths)
+	_, err = c.rbac.db.Exec(query, parentID, id)
+	if err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf("UPDATE %s SET %s = %s + ? WHERE id IN (%s)", table, Depth, Depth, placeholders(len(subtree)))
+	_, err = c.rbac.db.Exec(query, append([]interface{}{parentDepth + 1 - depth}, int64Args(subtree)...)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.rbac.db.Exec(fmt.Sprintf("UPDATE %s SET %s = ?, title = ? WHERE id=?", table, Parent), parentID, title, id)
+	return err
+}
+
+func (c closureEntity) insertBefore(title, description string, siblingID int64) (int64, error) {
+	return -1, ErrUnsupportedHierarchy
+}
+
+func (c closureEntity) insertAfter(title, description string, siblingID int64) (int64, error) {
+	return -1, ErrUnsupportedHierarchy
+}
+
+func (c closureEntity) reorder(parentID int64, ids []int64) error {
+	return ErrUnsupportedHierarchy
+}
+
+func (c closureEntity) within(descendant, ancestor string) string {
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM %s WHERE ancestor_id=%s.ID AND descendant_id=%s.ID)", c.paths, ancestor, descendant)
+}
+
+// verify checks the parent pointers, the depth column and the closure table
+// against each other.
+func (c closureEntity) verify() ([]TreeProblem, error) {
+	nodes, err := c.nestedNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	var rootID = c.rbac.rootID()
+	var parents = make(map[int64]int64, len(nodes))
+	for _, n := range nodes {
+		parents[n.id] = n.parent
+	}
+
+	var problems []TreeProblem
+	if _, ok := parents[rootID]; !ok {
+		problems = append(problems, TreeProblem{Kind: ProblemMissingRoot, Detail: fmt.Sprintf("no node with id %d", rootID)})
+	}
+
+	// Expected closure rows, keyed by ancestor and descendant.
+	var expected = make(map[[2]int64]int64)
+	for _, n := range nodes {
+		expected[[2]int64{n.id, n.id}] = 0
+
+		var depth int64
+		var orphan bool
+		var seen = map[int64]bool{n.id: true}
+		for id := n.id; id != rootID; {
+			var next = parents[id]
+			if _, ok := parents[next]; !ok || seen[next] {
+				problems = append(problems, TreeProblem{Kind: ProblemOrphan, ID: n.id, Detail: "not below the root"})
+				orphan = true
+				break
+			}
+			id = next
+			seen[id] = true
+			depth++
+			expected[[2]int64{id, n.id}] = depth
+		}
+
+		if !orphan && n.depth != depth {
+			problems = append(problems, TreeProblem{Kind: ProblemDepth, ID: n.id, Detail: fmt.Sprintf("%s is %d, parents say %d", Depth, n.depth, depth)})
+		}
+	}
+
+	rows, err := c.rbac.db.Query(fmt.Sprintf("SELECT ancestor_id, descendant_id, depth FROM %s", c.paths))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found = make(map[[2]int64]bool)
+	for rows.Next() {
+		var key [2]int64
+		var depth int64
+		if err := rows.Scan(&key[0], &key[1], &depth); err != nil {
+			return nil, err
+		}
+		found[key] = true
+
+		want, ok := expected[key]
+		if !ok {
+			problems = append(problems, TreeProblem{Kind: ProblemClosure, ID: key[1], Detail: fmt.Sprintf("unexpected ancestor %d", key[0])})
+		} else if want != depth {
+			problems = append(problems, TreeProblem{Kind: ProblemClosure, ID: key[1], Detail: fmt.Sprintf("ancestor %d at depth %d, expected %d", key[0], depth, want)})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var missing [][2]int64
+	for key := range expected {
+		if !found[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		if missing[i][1] != missing[j][1] {
+			return missing[i][1] < missing[j][1]
+		}
+		return missing[i][0] < missing[j][0]
+	})
+	for _, key := range missing {
+		problems = append(problems, TreeProblem{Kind: ProblemClosure, ID: key[1], Detail: fmt.Sprintf("missing ancestor %d", key[0])})
+	}
+
+	return problems, nil
+}
+
+// rebuild recomputes the depth column and the closure table from the parent pointers.
+func (c closureEntity) rebuild() error {
+	nodes, err := c.nestedNodes()
+	if err != nil {
+		return err
+	}
+
+	var rootID = c.rbac.rootID()
+	var table = c.entityHolder.getTable()
+
+	children, hasRoot := attachTree(rootID, nodes)
+	if !hasRoot {
+		_, err := c.rbac.db.Exec(fmt.Sprintf("INSERT INTO %s (id, title, description, %s, %s, %s, %s) VALUES (?,?,?,0,0,0,0)", table, Left, Right, Parent, Depth), rootID, "root", "root")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = c.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s", c.paths))
+	if err != nil {
+		return err
+	}
+
+	update := fmt.Sprintf("UPDATE %s SET %s = ?, %s = ? WHERE id=?", table, Parent, Depth)
+
+	var walk func(id, parentID int64, ancestors []int64) error
+	walk = func(id, parentID int64, ancestors []int64) error {
+		if _, err := c.rbac.db.Exec(update, parentID, len(ancestors), id); err != nil {
+			return err
+		}
+
+		var values []string
+		var args []interface{}
+		for i, ancestorID := range append(ancestors, id) {
+			values = append(values, "(?,?,?)")
+			args = append(args, ancestorID, id, len(ancestors)-i)
+		}
+		query := fmt.Sprintf("INSERT INTO %s (ancestor_id, descendant_id, depth) VALUES %s", c.paths, strings.Join(values, ","))
+		if _, err := c.rbac.db.Exec(query, args...); err != nil {
+			return err
+		}
+
+		for _, child := range children[id] {
+			if err := walk(child, id, append(ancestors[:len(ancestors):len(ancestors)], id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return walk(rootID, 0, nil)
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func int64Args(ids []int64) []interface{} {
+	var args = make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
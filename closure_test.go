@@ -0,0 +1,97 @@
+package gorbac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newClosureTest returns an Rbac using the closure table on the shared test
+// database. The closure tables are rebuilt from the parent pointers first,
+// and the nested sets are rebuilt when the test is done, so the test can run
+// in any order with the nested set tests.
+func newClosureTest(t *testing.T) *Rbac {
+	closure := New(&Config{Name: "smartident", Username: "root", Password: "pass", Host: "localhost", Port: 3306, Hierarchy: ClosureTable})
+	assert.Nil(t, closure.Roles().Rebuild())
+	assert.Nil(t, closure.Permissions().Rebuild())
+
+	t.Cleanup(func() {
+		assert.Nil(t, rbacTest.Roles().Rebuild())
+		assert.Nil(t, rbacTest.Permissions().Rebuild())
+	})
+
+	return closure
+}
+
+func TestClosureTable(t *testing.T) {
+	closure := newClosureTest(t)
+	t.Cleanup(func() {
+		closure.Roles().Remove("/closure", true)
+		closure.Permissions().Remove("/closure_articles", true)
+	})
+
+	_, err := closure.Roles().AddPath("/closure/staff/editor/senior", nil)
+	assert.Nil(t, err)
+
+	seniorID, err := closure.Roles().GetRoleID("/closure/staff/editor/senior")
+	assert.Nil(t, err)
+
+	depth, err := closure.Roles().Depth(seniorID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), depth)
+
+	path, err := closure.Roles().GetPath(seniorID)
+	assert.Nil(t, err)
+	assert.Equal(t, "/closure/staff/editor/senior", path)
+
+	_, err = closure.Permissions().AddPath("/closure_articles/publish", nil)
+	assert.Nil(t, err)
+
+	_, err = closure.Assign("/closure/staff/editor/senior", "/closure_articles")
+	assert.Nil(t, err)
+
+	_, err = closure.Users().Assign("/closure/staff", 405, nil)
+	assert.Nil(t, err)
+
+	success, err := closure.Check("/closure_articles/publish", 405)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = closure.Users().HasRole("/closure/staff/editor/senior", 405)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	err = closure.Roles().Move("/closure/staff/editor/senior", "/closure")
+	assert.Nil(t, err)
+
+	success, err = closure.Check("/closure_articles/publish", 405)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	err = closure.Roles().Move("/closure/staff", "/closure/staff/editor")
+	assert.Equal(t, ErrMoveIntoSelf, err)
+
+	err = closure.Roles().Remove("/closure/staff", false)
+	assert.Nil(t, err)
+
+	editorID, err := closure.Roles().GetRoleID("/closure/editor")
+	assert.Nil(t, err)
+
+	depth, err = closure.Roles().Depth(editorID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), depth)
+
+	problems, err := closure.Roles().Verify()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(problems))
+
+	_, err = closure.DB().Exec("DELETE FROM role_paths WHERE descendant_id=?", editorID)
+	assert.Nil(t, err)
+
+	err = closure.Roles().Rebuild()
+	assert.Nil(t, err)
+
+	problems, err = closure.Roles().Verify()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(problems))
+}
@@ -0,0 +1,532 @@
+package gorbac
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidCondition is returned when a condition expression cannot be parsed.
+var ErrInvalidCondition = errors.New("invalid condition")
+
+// Attributes describe the request a permission is checked for, such as
+// {"request.ip": "10.1.2.3", "time.hour": 14}. Nested maps can be used as well:
+// "request.ip" is looked up as a key first, then as "ip" inside "request".
+type Attributes map[string]interface{}
+
+// Condition is an expression that has to hold for an assignment to apply.
+//
+// The language is deliberately small:
+//
+//	time.hour >= 9 && time.hour < 17
+//	request.ip in "10.0.0.0/8"
+//	user.department in ["sales", "support"] || !user.contractor
+//
+// Values are numbers, "strings", true, false, [lists] and attribute names.
+// Operators are ==, !=, <, <=, >, >=, in, !, && and ||, plus parentheses.
+// "in" tests membership of a list or, for an IP address, of a CIDR range.
+// && and || short-circuit. A condition whose evaluation reaches a missing
+// attribute, or compares values of different types, does not hold.
+type Condition string
+
+// ConditionError describes where a condition expression is malformed.
+// It wraps ErrInvalidCondition.
+type ConditionError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *ConditionError) Error() string {
+	return fmt.Sprintf("%v at offset %d: %s", ErrInvalidCondition, e.Offset, e.Msg)
+}
+
+func (e *ConditionError) Unwrap() error {
+	return ErrInvalidCondition
+}
+
+// Validate parses the condition and reports the first syntax error.
+// An empty condition is valid and always holds.
+func (c Condition) Validate() error {
+	if strings.TrimSpace(string(c)) == "" {
+		return nil
+	}
+	_, err := parseCondition(string(c))
+	return err
+}
+
+// holds evaluates the condition. An empty condition always holds.
+func (c Condition) holds(attrs Attributes) bool {
+	if strings.TrimSpace(string(c)) == "" {
+		return true
+	}
+
+	expr, err := parseCondition(string(c))
+	if err != nil {
+		return false
+	}
+
+	value, err := expr.eval(attrs)
+	if err != nil {
+		return false
+	}
+
+	result, ok := value.(bool)
+	return ok && result
+}
+
+const (
+	maxConditionLength = 1024
+	maxConditionDepth  = 32
+)
+
+type conditionExpr interface {
+	eval(attrs Attributes) (interface{}, error)
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+type attributeExpr struct {
+	name string
+}
+
+type listExpr struct {
+	items []conditionExpr
+}
+
+type notExpr struct {
+	operand conditionExpr
+}
+
+type binaryExpr struct {
+	op          string
+	left, right conditionExpr
+}
+
+type conditionToken struct {
+	kind   string // ident, number, string, op or eof
+	text   string
+	value  interface{}
+	offset int
+}
+
+func lexCondition(input string) ([]conditionToken, error) {
+	var tokens []conditionToken
+
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			start := i
+			for i++; ; i++ {
+				if i >= len(input) {
+					return nil, &ConditionError{Offset: start, Msg: "unterminated string"}
+				}
+				if input[i] == '\\' && i+1 < len(input) {
+					i++
+					b.WriteByte(input[i])
+					continue
+				}
+				if input[i] == c {
+					break
+				}
+				b.WriteByte(input[i])
+			}
+			i++
+			tokens = append(tokens, conditionToken{kind: "string", text: input[start:i], value: b.String(), offset: start})
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(input) && input[i+1] >= '0' && input[i+1] <= '9':
+			start := i
+			for i++; i < len(input) && (input[i] >= '0' && input[i] <= '9' || input[i] == '.'); i++ {
+			}
+			number, err := strconv.ParseFloat(input[start:i], 64)
+			if err != nil {
+				return nil, &ConditionError{Offset: start, Msg: fmt.Sprintf("invalid number %q", input[start:i])}
+			}
+			tokens = append(tokens, conditionToken{kind: "number", text: input[start:i], value: number, offset: start})
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i++; i < len(input) && (input[i] == '_' || input[i] == '.' || input[i] >= 'a' && input[i] <= 'z' || input[i] >= 'A' && input[i] <= 'Z' || input[i] >= '0' && input[i] <= '9'); i++ {
+			}
+			tokens = append(tokens, conditionToken{kind: "ident", text: input[start:i], offset: start})
+		default:
+			var op string
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(input[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, &ConditionError{Offset: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+			tokens = append(tokens, conditionToken{kind: "op", text: op, offset: i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, conditionToken{kind: "eof", offset: len(input)}), nil
+}
+
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+	depth  int
+}
+
+func parseCondition(input string) (conditionExpr, error) {
+	if len(input) > maxConditionLength {
+		return nil, &ConditionError{Msg: fmt.Sprintf("longer than %d characters", maxConditionLength)}
+	}
+
+	tokens, err := lexCondition(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &conditionParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, &ConditionError{Offset: t.offset, Msg: fmt.Sprintf("unexpected %q", t.text)}
+	}
+
+	return expr, nil
+}
+
+func (p *conditionParser) peek() conditionToken {
+	return p.tokens[p.pos]
+}
+
+func (p *conditionParser) next() conditionToken {
+	t := p.tokens[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *conditionParser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind == "op" || t.kind == "ident" && t.text == "in" {
+		for _, op := range ops {
+			if t.text == op {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *conditionParser) expect(op string) error {
+	if !p.isOp(op) {
+		t := p.peek()
+		return &ConditionError{Offset: t.offset, Msg: fmt.Sprintf("expected %q", op)}
+	}
+	p.next()
+	return nil
+}
+
+func (p *conditionParser) or() (conditionExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) and() (conditionExpr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) not() (conditionExpr, error) {
+	if p.isOp("!") {
+		p.next()
+		operand, err := p.nested(p.not)
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{operand: operand}, nil
+	}
+	return p.comparison()
+}
+
+func (p *conditionParser) comparison() (conditionExpr, error) {
+	left, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("==", "!=", "<", "<=", ">", ">=", "in") {
+		op := p.next().text
+		right, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *conditionParser) value() (conditionExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case "number", "string":
+		return literalExpr{value: t.value}, nil
+	case "ident":
+		switch t.text {
+		case "true":
+			return literalExpr{value: true}, nil
+		case "false":
+			return literalExpr{value: false}, nil
+		case "in":
+			return nil, &ConditionError{Offset: t.offset, Msg: "unexpected \"in\""}
+		}
+		return attributeExpr{name: t.text}, nil
+	case "op":
+		switch t.text {
+		case "(":
+			expr, err := p.nested(p.or)
+			if err != nil {
+				return nil, err
+			}
+			return expr, p.expect(")")
+		case "[":
+			var list listExpr
+			for !p.isOp("]") {
+				if len(list.items) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				item, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+			}
+			p.next()
+			return list, nil
+		}
+	case "eof":
+		return nil, &ConditionError{Offset: t.offset, Msg: "unexpected end of condition"}
+	}
+
+	return nil, &ConditionError{Offset: t.offset, Msg: fmt.Sprintf("unexpected %q", t.text)}
+}
+
+// nested guards against conditions that nest deep enough to exhaust the stack.
+func (p *conditionParser) nested(fn func() (conditionExpr, error)) (conditionExpr, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxConditionDepth {
+		return nil, &ConditionError{Offset: p.peek().offset, Msg: "nested too deeply"}
+	}
+	return fn()
+}
+
+func (e literalExpr) eval(attrs Attributes) (interface{}, error) {
+	return e.value, nil
+}
+
+func (e attributeExpr) eval(attrs Attributes) (interface{}, error) {
+	if value, ok := attrs[e.name]; ok {
+		return normalizeAttribute(value), nil
+	}
+
+	// Walk nested maps, e.g. attrs["request"]["ip"].
+	var current interface{} = map[string]interface{}(attrs)
+	for _, part := range strings.Split(e.name, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			if a, isAttrs := current.(Attributes); isAttrs {
+				m, ok = a, true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("attribute %q not found", e.name)
+		}
+		if current, ok = m[part]; !ok {
+			return nil, fmt.Errorf("attribute %q not found", e.name)
+		}
+	}
+
+	return normalizeAttribute(current), nil
+}
+
+// normalizeAttribute turns caller supplied values into the types the
+// evaluator works with: float64 for numbers and strings for IP addresses.
+func normalizeAttribute(value interface{}) interface{} {
+	if ip, ok := value.(net.IP); ok {
+		return ip.String()
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Slice, reflect.Array:
+		var items []interface{}
+		for i := 0; i < rv.Len(); i++ {
+			items = append(items, normalizeAttribute(rv.Index(i).Interface()))
+		}
+		return items
+	}
+
+	return value
+}
+
+func (e listExpr) eval(attrs Attributes) (interface{}, error) {
+	var items []interface{}
+	for _, item := range e.items {
+		value, err := item.eval(attrs)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+	return items, nil
+}
+
+func (e notExpr) eval(attrs Attributes) (interface{}, error) {
+	value, err := e.operand.eval(attrs)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs a boolean, got %T", value)
+	}
+	return !b, nil
+}
+
+func (e binaryExpr) eval(attrs Attributes) (interface{}, error) {
+	left, err := e.left.eval(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || short-circuit, so a missing attribute on the right does not
+	// matter when the left side already decides.
+	if e.op == "&&" || e.op == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %T", e.op, left)
+		}
+		if l == (e.op == "||") {
+			return l, nil
+		}
+		right, err := e.right.eval(attrs)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s needs booleans, got %T", e.op, right)
+		}
+		return r, nil
+	}
+
+	right, err := e.right.eval(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "==", "!=":
+		if reflect.TypeOf(left) != reflect.TypeOf(right) {
+			return nil, fmt.Errorf("cannot compare %T with %T", left, right)
+		}
+		return reflect.DeepEqual(left, right) == (e.op == "=="), nil
+	case "in":
+		return evalIn(left, right)
+	}
+
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %T with %T", left, right)
+		}
+		return compare(e.op, l < r, l == r), nil
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare %T with %T", left, right)
+		}
+		return compare(e.op, l < r, l == r), nil
+	}
+
+	return nil, fmt.Errorf("%s is not defined for %T", e.op, left)
+}
+
+func compare(op string, less, equal bool) bool {
+	switch op {
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	}
+	return !less
+}
+
+func evalIn(needle, haystack interface{}) (interface{}, error) {
+	switch h := haystack.(type) {
+	case []interface{}:
+		for _, item := range h {
+			if reflect.DeepEqual(needle, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case string:
+		address, ok := needle.(string)
+		if !ok {
+			return nil, fmt.Errorf("in needs an IP address, got %T", needle)
+		}
+		_, network, err := net.ParseCIDR(h)
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address", address)
+		}
+		return network.Contains(ip), nil
+	}
+
+	return nil, fmt.Errorf("in needs a list or a CIDR range, got %T", haystack)
+}
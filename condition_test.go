@@ -0,0 +1,42 @@
+package gorbac
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditionHolds(t *testing.T) {
+	attrs := Attributes{
+		"time.hour":       14,
+		"request":         map[string]interface{}{"ip": net.ParseIP("10.1.2.3")},
+		"user.department": "sales",
+		"user.contractor": false,
+	}
+
+	cases := map[Condition]bool{
+		"":                                 true,
+		"time.hour >= 9 && time.hour < 17": true,
+		"time.hour >= 15":                  false,
+		`request.ip in "10.0.0.0/8"`:       true,
+		`request.ip in "192.168.0.0/16"`:   false,
+		`user.department in ["sales", "support"]`: true,
+		"!user.contractor":                        true,
+		"missing == 1":                            false,
+		"true || missing == 1":                    true,
+		`time.hour == "14"`:                       false,
+	}
+
+	for condition, expected := range cases {
+		assert.Nil(t, condition.Validate(), string(condition))
+		assert.Equal(t, expected, condition.holds(attrs), string(condition))
+	}
+}
+
+func TestConditionInvalid(t *testing.T) {
+	for _, condition := range []Condition{"a ==", "(a", "a b", `"x`, "a # b", "[1,", "in"} {
+		assert.True(t, errors.Is(condition.Validate(), ErrInvalidCondition), string(condition))
+	}
+}
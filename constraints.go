@@ -0,0 +1,477 @@
+package gorbac
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidConstraint  = errors.New("a constraint needs a name, at least two unrelated roles and a cardinality between 2 and the number of roles")
+	ErrConstraintExists   = errors.New("a constraint with this name already exists")
+	ErrConstraintNotFound = errors.New("constraint not found")
+	ErrSSDViolation       = errors.New("static separation of duty violation")
+	ErrDSDViolation       = errors.New("dynamic separation of duty violation")
+)
+
+// Constraints manages separation of duty constraints.
+type Constraints struct {
+	rbac *Rbac
+}
+
+// constraintTables names the tables of one kind of constraint, and the kind
+// its changes are audited as.
+type constraintTables struct {
+	kind        ChangeKind
+	constraints string
+	roles       string
+}
+
+var (
+	ssdTables = constraintTables{KindSSD, "ssd_constraints", "ssd_constraint_roles"}
+	dsdTables = constraintTables{KindDSD, "dsd_constraints", "dsd_constraint_roles"}
+)
+
+// SSD is a static separation of duty constraint: no user may hold
+// Cardinality or more of its roles at the same time, whether assigned
+// directly or reached through the role tree and inheritance. The root role
+// reaches every role and is exempt.
+type SSD struct {
+	ID          int64
+	Name        string
+	Cardinality int
+	RoleIDs     []int64
+}
+
+// DSD is a dynamic separation of duty constraint: a user may be assigned
+// any of its roles, but no session may activate Cardinality or more of them
+// at the same time.
+type DSD SSD
+
+// SSDViolation describes a user holding too many roles of a constraint.
+type SSDViolation struct {
+	Constraint  string
+	Cardinality int
+	Owner       Owner
+	Roles       []string
+}
+
+func (v *SSDViolation) Error() string {
+	return fmt.Sprintf("%v: user %v would hold %s, but constraint %q allows fewer than %d of its roles",
+		ErrSSDViolation, v.Owner, strings.Join(v.Roles, ", "), v.Constraint, v.Cardinality)
+}
+
+func (v *SSDViolation) Unwrap() error {
+	return ErrSSDViolation
+}
+
+// Constraints returns the separation of duty constraint manager.
+func (r Rbac) Constraints() Constraints {
+	return Constraints{rbac: &r}
+}
+
+// AddSSD stores a static separation of duty constraint. A cardinality of 2
+// means a user may hold at most one of roles. Existing assignments are not
+// checked; use Violations to find them.
+func (c Constraints) AddSSD(name string, roles []RoleInterface, cardinality int) (int64, error) {
+	return c.add(ssdTables, name, roles, cardinality)
+}
+
+// AddDSD stores a dynamic separation of duty constraint. A cardinality of 2
+// means a session may activate at most one of roles. Sessions that already
+// have conflicting roles active keep them.
+func (c Constraints) AddDSD(name string, roles []RoleInterface, cardinality int) (int64, error) {
+	return c.add(dsdTables, name, roles, cardinality)
+}
+
+func (c Constraints) add(tables constraintTables, name string, roles []RoleInterface, cardinality int) (int64, error) {
+	var roleIDs []int64
+	var seen = make(map[int64]bool, len(roles))
+	for _, role := range roles {
+		roleID, err := c.rbac.roles.GetRoleID(role)
+		if err != nil {
+			return 0, err
+		}
+		if !seen[roleID] {
+			seen[roleID] = true
+			roleIDs = append(roleIDs, roleID)
+		}
+	}
+
+	if name == "" || len(roleIDs) < 2 || cardinality < 2 || cardinality > len(roleIDs) {
+		return 0, ErrInvalidConstraint
+	}
+
+	// A role that reaches another role of the constraint would always
+	// violate it on its own.
+	for _, roleID := range roleIDs {
+		reachable, err := c.rbac.roles.expand([]int64{roleID})
+		if err != nil {
+			return 0, err
+		}
+		for _, id := range reachable {
+			if id != roleID && seen[id] {
+				return 0, ErrInvalidConstraint
+			}
+		}
+	}
+
+	var constraintID int64
+	err := c.rbac.audited(tables.kind, ActionAdd, func(tx *Rbac, record *auditRecord) error {
+		state, err := tx.Constraints().auditConstraint(name, cardinality, roleIDs)
+		if err != nil {
+			return err
+		}
+		record.after = state
+
+		var count int64
+		if err := tx.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE name=?", tables.constraints), name).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrConstraintExists
+		}
+
+		res, err := tx.db.Exec(fmt.Sprintf("INSERT INTO %s (name, cardinality) VALUES(?,?)", tables.constraints), name, cardinality)
+		if err != nil {
+			return err
+		}
+		constraintID, _ = res.LastInsertId()
+
+		for _, roleID := range roleIDs {
+			if _, err := tx.db.Exec(fmt.Sprintf("INSERT INTO %s (constraint_id, role_id) VALUES(?,?)", tables.roles), constraintID, roleID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return constraintID, nil
+}
+
+// RemoveSSD deletes a constraint added by AddSSD.
+func (c Constraints) RemoveSSD(name string) error {
+	return c.remove(ssdTables, name)
+}
+
+// RemoveDSD deletes a constraint added by AddDSD.
+func (c Constraints) RemoveDSD(name string) error {
+	return c.remove(dsdTables, name)
+}
+
+func (c Constraints) remove(tables constraintTables, name string) error {
+	return c.rbac.audited(tables.kind, ActionRemove, func(tx *Rbac, record *auditRecord) error {
+		var constraintID int64
+		var cardinality int
+		err := tx.db.QueryRow(fmt.Sprintf("SELECT ID, cardinality FROM %s WHERE name=? FOR UPDATE", tables.constraints), name).Scan(&constraintID, &cardinality)
+		if err == sql.ErrNoRows {
+			return ErrConstraintNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		roleIDs, err := tx.Constraints().roleIDs(tables, constraintID)
+		if err != nil {
+			return err
+		}
+		if record.before, err = tx.Constraints().auditConstraint(name, cardinality, roleIDs); err != nil {
+			return err
+		}
+
+		if _, err := tx.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE constraint_id=?", tables.roles), constraintID); err != nil {
+			return err
+		}
+		_, err = tx.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE ID=?", tables.constraints), constraintID)
+		return err
+	})
+}
+
+func (c Constraints) roleIDs(tables constraintTables, constraintID int64) ([]int64, error) {
+	rows, err := c.rbac.db.Query(fmt.Sprintf("SELECT role_id FROM %s WHERE constraint_id=? ORDER BY role_id", tables.roles), constraintID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roleIDs []int64
+	for rows.Next() {
+		var roleID int64
+		if err := rows.Scan(&roleID); err != nil {
+			return nil, err
+		}
+		roleIDs = append(roleIDs, roleID)
+	}
+
+	return roleIDs, rows.Err()
+}
+
+func (c Constraints) auditConstraint(name string, cardinality int, roleIDs []int64) (auditConstraint, error) {
+	var state = auditConstraint{Name: name, Cardinality: cardinality, Roles: []string{}}
+	for _, roleID := range roleIDs {
+		role, err := c.rbac.roles.GetPath(roleID)
+		if err != nil {
+			return state, err
+		}
+		state.Roles = append(state.Roles, role)
+	}
+
+	return state, nil
+}
+
+// SSDs returns every static separation of duty constraint, ordered by name.
+func (c Constraints) SSDs() ([]SSD, error) {
+	return c.load(ssdTables)
+}
+
+// DSDs returns every dynamic separation of duty constraint, ordered by name.
+func (c Constraints) DSDs() ([]DSD, error) {
+	constraints, err := c.load(dsdTables)
+	if err != nil {
+		return nil, err
+	}
+
+	var dsds = make([]DSD, len(constraints))
+	for i, constraint := range constraints {
+		dsds[i] = DSD(constraint)
+	}
+
+	return dsds, nil
+}
+
+func (c Constraints) load(tables constraintTables) ([]SSD, error) {
+	rows, err := c.rbac.db.Query(fmt.Sprintf(`SELECT C.ID, C.name, C.cardinality, CR.role_id
+	FROM %s AS C
+	JOIN %s AS CR ON (CR.constraint_id=C.ID)
+	ORDER BY C.name, CR.role_id`, tables.constraints, tables.roles))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var constraints []SSD
+	for rows.Next() {
+		var constraint SSD
+		var roleID int64
+		if err := rows.Scan(&constraint.ID, &constraint.Name, &constraint.Cardinality, &roleID); err != nil {
+			return nil, err
+		}
+		if n := len(constraints); n > 0 && constraints[n-1].ID == constraint.ID {
+			constraints[n-1].RoleIDs = append(constraints[n-1].RoleIDs, roleID)
+			continue
+		}
+		constraint.RoleIDs = []int64{roleID}
+		constraints = append(constraints, constraint)
+	}
+
+	return constraints, rows.Err()
+}
+
+// Violations lists every user whose current assignments break a constraint,
+// for example because the constraint was added after the assignments.
+func (c Constraints) Violations() ([]*SSDViolation, error) {
+	constraints, err := c.SSDs()
+	if err != nil || len(constraints) == 0 {
+		return nil, err
+	}
+
+	return c.violations(constraints, "SELECT user_id, role_id FROM user_roles WHERE valid_until IS NULL OR valid_until > ?", time.Now().UTC())
+}
+
+// violations evaluates the constraints for the users and roles listed by
+// query, which selects user_id and role_id pairs.
+func (c Constraints) violations(constraints []SSD, query string, args ...interface{}) ([]*SSDViolation, error) {
+	rows, err := c.rbac.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []string
+	var userRoles = make(map[string][]int64)
+	for rows.Next() {
+		var user string
+		var roleID int64
+		if err := rows.Scan(&user, &roleID); err != nil {
+			return nil, err
+		}
+		if _, ok := userRoles[user]; !ok {
+			users = append(users, user)
+		}
+		userRoles[user] = append(userRoles[user], roleID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	sort.Slice(users, func(i, j int) bool {
+		return lessOwner(users[i], users[j])
+	})
+
+	var violations []*SSDViolation
+	for _, user := range users {
+		found, err := c.evaluate(constraints, user, userRoles[user])
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, found...)
+	}
+
+	return violations, nil
+}
+
+// checkAssign returns the first constraint that assigning roleID to owner in
+// table would newly break. Assignments that have expired are not counted.
+// The owner's assignments are locked until the transaction ends, so
+// concurrent assignments to the same owner are checked one after the other.
+func (c Constraints) checkAssign(table string, owner Owner, roleID int64) error {
+	constraints, err := c.SSDs()
+	if err != nil || len(constraints) == 0 {
+		return err
+	}
+
+	rows, err := c.rbac.db.Query(fmt.Sprintf("SELECT role_id FROM %s WHERE user_id=? AND (valid_until IS NULL OR valid_until > ?) FOR UPDATE", table), owner, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var roleIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		roleIDs = append(roleIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	before, err := c.evaluate(constraints, owner, roleIDs)
+	if err != nil {
+		return err
+	}
+	after, err := c.evaluate(constraints, owner, append(roleIDs, roleID))
+	if err != nil {
+		return err
+	}
+
+	return newViolation(before, after)
+}
+
+// guard runs change in a transaction and rolls it back if it leaves a user
+// with a violation that user did not have before. Changes to the role graph,
+// such as new inheritance edges, can break constraints without any new
+// user assignment. Only roles that cover pivotID can reach new roles through
+// the change, so only the users holding one of them are evaluated.
+func (c Constraints) guard(pivotID int64, change func(tx *Rbac) error) error {
+	return c.rbac.transaction(func(tx *Rbac) error {
+		constraints, err := tx.Constraints().SSDs()
+		if err != nil {
+			return err
+		}
+		if len(constraints) == 0 {
+			return change(tx)
+		}
+
+		cte, args := tx.roles.coverers(pivotID)
+		query := fmt.Sprintf(`%s SELECT user_id, role_id FROM user_roles
+		WHERE (valid_until IS NULL OR valid_until > ?)
+		AND user_id IN (SELECT TRel.user_id FROM user_roles AS TRel JOIN coverers ON (coverers.id=TRel.role_id))`, cte)
+		args = append(args, time.Now().UTC())
+
+		before, err := tx.Constraints().violations(constraints, query, args...)
+		if err != nil {
+			return err
+		}
+
+		if err := change(tx); err != nil {
+			return err
+		}
+
+		after, err := tx.Constraints().violations(constraints, query, args...)
+		if err != nil {
+			return err
+		}
+
+		return newViolation(before, after)
+	})
+}
+
+// newViolation returns the first violation in after that is not in before.
+func newViolation(before, after []*SSDViolation) error {
+	var known = make(map[string]bool, len(before))
+	for _, v := range before {
+		known[fmt.Sprintf("%v\x00%s", v.Owner, v.Constraint)] = true
+	}
+	for _, v := range after {
+		if !known[fmt.Sprintf("%v\x00%s", v.Owner, v.Constraint)] {
+			return v
+		}
+	}
+
+	return nil
+}
+
+func (c Constraints) evaluate(constraints []SSD, owner Owner, roleIDs []int64) ([]*SSDViolation, error) {
+	var assigned []int64
+	for _, id := range roleIDs {
+		if id != c.rbac.rootID() {
+			assigned = append(assigned, id)
+		}
+	}
+	if len(assigned) == 0 {
+		return nil, nil
+	}
+
+	roleIDs, err := c.rbac.roles.expand(assigned)
+	if err != nil {
+		return nil, err
+	}
+
+	var held = make(map[int64]bool, len(roleIDs))
+	for _, id := range roleIDs {
+		held[id] = true
+	}
+
+	var violations []*SSDViolation
+	for _, constraint := range constraints {
+		var roles []string
+		for _, id := range constraint.RoleIDs {
+			if !held[id] {
+				continue
+			}
+			path, err := c.rbac.roles.GetPath(id)
+			if err != nil {
+				return nil, err
+			}
+			roles = append(roles, path)
+		}
+
+		if len(roles) >= constraint.Cardinality {
+			violations = append(violations, &SSDViolation{Constraint: constraint.Name, Cardinality: constraint.Cardinality, Owner: owner, Roles: roles})
+		}
+	}
+
+	return violations, nil
+}
+
+// removeRole drops a role from every constraint it is part of.
+func (c Constraints) removeRole(roleID int64) error {
+	for _, tables := range []constraintTables{ssdTables, dsdTables} {
+		if _, err := c.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE role_id=?", tables.roles), roleID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package gorbac
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Decision operations
+const (
+	DecisionCheck   = "check"
+	DecisionHasRole = "has_role"
+)
+
+// Decision is a single authorization decision made by Rbac.Check,
+// Rbac.CheckWithAttributes or Users.HasRole. MatchedRole is the assigned
+// role through which access was granted, and is empty for a denial.
+type Decision struct {
+	Time        time.Time     `json:"time"`
+	Operation   string        `json:"operation"`
+	User        string        `json:"user"`
+	Permission  string        `json:"permission,omitempty"`
+	Role        string        `json:"role,omitempty"`
+	Result      bool          `json:"result"`
+	MatchedRole string        `json:"matched_role,omitempty"`
+	Latency     time.Duration `json:"latency_ns"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// DecisionLogger receives authorization decisions. It is called from the
+// goroutine making the decision, so implementations must be safe for
+// concurrent use and should not block.
+type DecisionLogger interface {
+	LogDecision(decision Decision)
+}
+
+// ErrInvalidSampleRate is returned by DecisionLogOptions.Validate for a
+// SampleRate outside [0, 1].
+var ErrInvalidSampleRate = errors.New("decision sample rate must be between 0 and 1")
+
+// DecisionLogOptions configures decision logging. Decisions are not logged
+// while Logger is nil.
+// SampleRate is the fraction of decisions that is logged, between 0 and 1.
+// It defaults to 1 when left at 0, so every decision is logged; leave Logger
+// nil to log none.
+// Redact, when set, is applied to every decision before it is logged.
+type DecisionLogOptions struct {
+	Logger     DecisionLogger
+	SampleRate float64
+	Redact     func(Decision) Decision
+}
+
+// Validate rejects a SampleRate outside [0, 1].
+func (o DecisionLogOptions) Validate() error {
+	if !(o.SampleRate >= 0 && o.SampleRate <= 1) {
+		return ErrInvalidSampleRate
+	}
+	return nil
+}
+
+// RedactUser removes the user from a decision.
+func RedactUser(decision Decision) Decision {
+	decision.User = ""
+	return decision
+}
+
+// HashUser returns a redaction that replaces the user with a keyed hash, so
+// the decisions of one user can still be correlated.
+func HashUser(key []byte) func(Decision) Decision {
+	return func(decision Decision) Decision {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(decision.User))
+		decision.User = hex.EncodeToString(mac.Sum(nil))[:16]
+		return decision
+	}
+}
+
+// JSONLinesLogger writes every decision as a line of JSON.
+type JSONLinesLogger struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+}
+
+func NewJSONLinesLogger(writer io.Writer) *JSONLinesLogger {
+	return &JSONLinesLogger{encoder: json.NewEncoder(writer)}
+}
+
+// OpenDecisionLog appends decisions to the file at path, creating it when needed.
+func OpenDecisionLog(path string) (*JSONLinesLogger, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	var logger = NewJSONLinesLogger(file)
+	logger.closer = file
+	return logger, nil
+}
+
+// LogDecision writes decision. Write errors are logged, as a failing sink
+// must not fail the decision itself.
+func (l *JSONLinesLogger) LogDecision(decision Decision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.encoder.Encode(decision); err != nil {
+		log.Println(err)
+	}
+}
+
+// Close closes the file opened by OpenDecisionLog.
+func (l *JSONLinesLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// RingBufferLogger keeps the most recent decisions in memory.
+type RingBufferLogger struct {
+	mu        sync.Mutex
+	decisions []Decision
+	next      int
+	full      bool
+}
+
+func NewRingBufferLogger(size int) *RingBufferLogger {
+	if size < 1 {
+		size = 1
+	}
+	return &RingBufferLogger{decisions: make([]Decision, size)}
+}
+
+func (b *RingBufferLogger) LogDecision(decision Decision) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.decisions[b.next] = decision
+	b.next = (b.next + 1) % len(b.decisions)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Decisions returns the buffered decisions, oldest first.
+func (b *RingBufferLogger) Decisions() []Decision {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.full {
+		return append([]Decision(nil), b.decisions[:b.next]...)
+	}
+	return append(append([]Decision(nil), b.decisions[b.next:]...), b.decisions[:b.next]...)
+}
+
+// logDecision completes and logs decision if it is sampled. matchedRoleID
+// is the assigned role that led to a positive result.
+func (r Rbac) logDecision(decision Decision, start time.Time, result bool, err error, matchedRoleID int64) {
+	var options = r.decisions
+	if options.Logger == nil {
+		return
+	}
+	if options.SampleRate != 0 && rand.Float64() >= options.SampleRate {
+		return
+	}
+
+	decision.Time = start.UTC()
+	decision.Latency = time.Since(start)
+	decision.Result = result
+	if err != nil {
+		decision.Error = err.Error()
+	}
+
+	if result && matchedRoleID != 0 {
+		decision.MatchedRole, _ = r.roles.GetPath(matchedRoleID)
+	}
+
+	if options.Redact != nil {
+		decision = options.Redact(decision)
+	}
+
+	options.Logger.LogDecision(decision)
+}
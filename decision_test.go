@@ -0,0 +1,75 @@
+package gorbac
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingBufferLogger(t *testing.T) {
+	var buffer = NewRingBufferLogger(3)
+	assert.Len(t, buffer.Decisions(), 0)
+
+	for _, user := range []string{"a", "b", "c", "d", "e"} {
+		buffer.LogDecision(Decision{User: user})
+	}
+
+	var users []string
+	for _, decision := range buffer.Decisions() {
+		users = append(users, decision.User)
+	}
+	assert.Equal(t, []string{"c", "d", "e"}, users)
+}
+
+func TestJSONLinesLogger(t *testing.T) {
+	var out bytes.Buffer
+	var logger = NewJSONLinesLogger(&out)
+
+	logger.LogDecision(Decision{Operation: DecisionCheck, User: "7", Permission: "/read", Result: true, MatchedRole: "/reader"})
+	logger.LogDecision(Decision{Operation: DecisionHasRole, User: "8", Role: "/admin"})
+	assert.Nil(t, logger.Close())
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	if assert.Len(t, lines, 2) {
+		var decision Decision
+		assert.Nil(t, json.Unmarshal(lines[0], &decision))
+		assert.Equal(t, "/reader", decision.MatchedRole)
+		assert.Equal(t, true, decision.Result)
+		assert.NotContains(t, string(lines[1]), "matched_role")
+	}
+}
+
+func TestDecisionSampling(t *testing.T) {
+	var buffer = NewRingBufferLogger(1000)
+	var r = Rbac{decisions: DecisionLogOptions{Logger: buffer, SampleRate: 0.1, Redact: RedactUser}}
+
+	for i := 0; i < 1000; i++ {
+		r.logDecision(Decision{User: "7"}, time.Now(), false, nil, 0)
+	}
+
+	logged := buffer.Decisions()
+	assert.True(t, len(logged) > 0 && len(logged) < 300, len(logged))
+	for _, decision := range logged {
+		assert.Equal(t, "", decision.User)
+	}
+}
+
+func TestDecisionSampleRate(t *testing.T) {
+	for _, rate := range []float64{0, 0.5, 1} {
+		assert.Nil(t, DecisionLogOptions{SampleRate: rate}.Validate(), rate)
+	}
+	for _, rate := range []float64{-0.1, 1.5, math.NaN()} {
+		assert.Equal(t, ErrInvalidSampleRate, DecisionLogOptions{SampleRate: rate}.Validate(), rate)
+	}
+
+	var buffer = NewRingBufferLogger(10)
+	var r = Rbac{decisions: DecisionLogOptions{Logger: buffer}}
+	for i := 0; i < 10; i++ {
+		r.logDecision(Decision{User: "7"}, time.Now(), false, nil, 0)
+	}
+	assert.Len(t, buffer.Decisions(), 10)
+}
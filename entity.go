@@ -15,12 +15,12 @@ type entityInternal interface {
 	assign(role RoleInterface, permission PermissionInterface) (int64, error)
 	count() (int64, error)
 	depth(id int64) (int64, error)
-	descendants(absolute bool, id int64) ([]path, error)
+	descendants(absolute bool, id int64) ([]Node, error)
 
 	edit(id int64, title, description string) error
 	unassign(role RoleInterface, permission PermissionInterface) error
 	returnID(entity string) (int64, error)
-	children(id int64) ([]path, error)
+	children(id int64) ([]Node, error)
 	getDescription(id int64) (string, error)
 	getTitle(id int64) (string, error)
 
@@ -30,10 +30,24 @@ type entityInternal interface {
 
 	pathID(path string) (int64, error)
 	titleID(title string) (int64, error)
+	titleIDs(title string) ([]int64, error)
 	deleteConditional(id int64) error
 	deleteSubtreeConditional(id int64) error
-	pathConditional(id int64) ([]path, error)
+	pathConditional(id int64) ([]Node, error)
+	siblings(id int64) ([]Node, error)
+	leaves(id int64) ([]Node, error)
+	subtreeSize(id int64) (int64, error)
 	parentNode(id int64) (int64, error)
+	move(id int64, parentID int64, title string) error
+	insertBefore(title, description string, siblingID int64) (int64, error)
+	insertAfter(title, description string, siblingID int64) (int64, error)
+	reorder(parentID int64, ids []int64) error
+	verify() ([]TreeProblem, error)
+	rebuild() error
+
+	// within returns an SQL condition that holds when the row aliased as
+	// descendant is the row aliased as ancestor or lies below it.
+	within(descendant, ancestor string) string
 }
 
 type entityHolder interface {
@@ -42,23 +56,64 @@ type entityHolder interface {
 
 // Left column name in sql scheme
 // Right column name in sql scheme
+// Parent column name in sql scheme
+// Depth column name in sql scheme
 const (
-	Left  string = "lft"
-	Right        = "rght"
+	Left   string = "lft"
+	Right         = "rght"
+	Parent        = "parent_id"
+	Depth         = "depth"
 )
 
 // Error messages for a invalid title name.
 var (
 	ErrTitleNotFound = errors.New("title not found")
 	ErrPathNotFound  = errors.New("path not found")
+	ErrMoveRoot      = errors.New("the root node cannot be moved")
+	ErrMoveIntoSelf  = errors.New("a node cannot be moved below itself or its descendants")
+
+	ErrRootSibling     = errors.New("the root node cannot have siblings")
+	ErrReorderChildren = errors.New("order must list every child exactly once")
+
+	ErrInvalidTitle   = errors.New("title must not be empty or contain '/'")
+	ErrDuplicateTitle = errors.New("a sibling with this title already exists")
+	ErrRenameRoot     = errors.New("the root node cannot be renamed")
+	ErrTitleInUse     = errors.New("title is already used by another node")
+	ErrAmbiguousTitle = errors.New("title matches more than one node")
 )
 
+// AmbiguousTitleError is returned when a title lookup matches several nodes.
+// It wraps ErrAmbiguousTitle.
+type AmbiguousTitleError struct {
+	Title string
+	Paths []string
+}
+
+func (e *AmbiguousTitleError) Error() string {
+	return fmt.Sprintf("title %q matches more than one node: %s", e.Title, strings.Join(e.Paths, ", "))
+}
+
+func (e *AmbiguousTitleError) Unwrap() error {
+	return ErrAmbiguousTitle
+}
+
 type entity struct {
 	rbac         *Rbac
 	entityHolder entityHolder
 }
 
-type path struct {
+// newEntity returns the hierarchy strategy selected in the Config.
+func newEntity(r *Rbac, holder entityHolder) entityInternal {
+	if r.hierarchy == ClosureTable {
+		return newClosureEntity(r, holder)
+	}
+	return &entity{rbac: r, entityHolder: holder}
+}
+
+// Node is a single role or permission in a tree. Depth is relative to the
+// node a query started from for Descendants and Children, and counted from
+// the root everywhere else.
+type Node struct {
 	ID          int64
 	Title       string
 	Description string
@@ -82,29 +137,39 @@ func (e entity) add(title, description string, parentID int64) (int64, error) {
 	}
 
 	var query string
-	var left, right int
+	var left, right, depth int64
 
-	query = fmt.Sprintf("SELECT `%s` AS `right`, `%s` AS `left` FROM %s WHERE id=?", Right, Left, e.entityHolder.getTable())
+	query = fmt.Sprintf("SELECT `%s` AS `right`, `%s` AS `left`, `%s` FROM %s WHERE id=?", Right, Left, Depth, e.entityHolder.getTable())
 
-	err := e.rbac.db.QueryRow(query, parentID).Scan(&right, &left)
+	err := e.rbac.db.QueryRow(query, parentID).Scan(&right, &left, &depth)
 	if err != nil {
 		return -1, err
 	}
 
-	query = fmt.Sprintf("UPDATE %s SET %s = %s + 2 WHERE %s >= ?", e.entityHolder.getTable(), Right, Right, Right)
-	_, err = e.rbac.db.Exec(query, right)
+	if err := e.checkTitle(title, parentID, 0); err != nil {
+		return -1, err
+	}
+
+	return e.insertAt(title, description, right, parentID, depth+1)
+}
+
+// insertAt creates a leaf node with its left value at position, shifting
+// everything from position onwards two places to the right.
+func (e entity) insertAt(title, description string, position, parentID, depth int64) (int64, error) {
+	query := fmt.Sprintf("UPDATE %s SET %s = %s + 2 WHERE %s >= ?", e.entityHolder.getTable(), Right, Right, Right)
+	_, err := e.rbac.db.Exec(query, position)
 	if err != nil {
 		return -1, err
 	}
 
-	query = fmt.Sprintf("UPDATE %s SET %s = %s + 2 WHERE %s > ?", e.entityHolder.getTable(), Left, Left, Left)
-	_, err = e.rbac.db.Exec(query, right)
+	query = fmt.Sprintf("UPDATE %s SET %s = %s + 2 WHERE %s >= ?", e.entityHolder.getTable(), Left, Left, Left)
+	_, err = e.rbac.db.Exec(query, position)
 	if err != nil {
 		return -1, err
 	}
 
-	query = fmt.Sprintf("INSERT INTO %s (`%s`, `%s`, `title`, `description`) VALUES (?,?,?,?)", e.entityHolder.getTable(), Right, Left)
-	res, err := e.rbac.db.Exec(query, right+1, right, title, description)
+	query = fmt.Sprintf("INSERT INTO %s (`%s`, `%s`, `%s`, `%s`, `title`, `description`) VALUES (?,?,?,?,?,?)", e.entityHolder.getTable(), Right, Left, Parent, Depth)
+	res, err := e.rbac.db.Exec(query, position+1, position, parentID, depth, title, description)
 	if err != nil {
 		return -1, err
 	}
@@ -113,19 +178,168 @@ func (e entity) add(title, description string, parentID int64) (int64, error) {
 	return insertID, nil
 }
 
+// insertBefore creates a node as the sibling directly before siblingID.
+func (e entity) insertBefore(title, description string, siblingID int64) (int64, error) {
+	if siblingID == e.rbac.rootID() {
+		return -1, ErrRootSibling
+	}
+
+	var left, parentID, depth int64
+	query := fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE id=?", Left, Parent, Depth, e.entityHolder.getTable())
+	if err := e.rbac.db.QueryRow(query, siblingID).Scan(&left, &parentID, &depth); err != nil {
+		return -1, err
+	}
+	if err := e.checkTitle(title, parentID, 0); err != nil {
+		return -1, err
+	}
+
+	return e.insertAt(title, description, left, parentID, depth)
+}
+
+// insertAfter creates a node as the sibling directly after siblingID.
+func (e entity) insertAfter(title, description string, siblingID int64) (int64, error) {
+	if siblingID == e.rbac.rootID() {
+		return -1, ErrRootSibling
+	}
+
+	var right, parentID, depth int64
+	query := fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE id=?", Right, Parent, Depth, e.entityHolder.getTable())
+	if err := e.rbac.db.QueryRow(query, siblingID).Scan(&right, &parentID, &depth); err != nil {
+		return -1, err
+	}
+	if err := e.checkTitle(title, parentID, 0); err != nil {
+		return -1, err
+	}
+
+	return e.insertAt(title, description, right+1, parentID, depth)
+}
+
+// reorder rearranges the children of parentID in the given order.
+// Every child has to be listed exactly once.
+func (e entity) reorder(parentID int64, ids []int64) error {
+	if parentID == 0 {
+		parentID = e.rbac.rootID()
+	}
+
+	var table = e.entityHolder.getTable()
+	var parentLeft, parentRight int64
+	query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE id=?", Left, Right, table)
+	if err := e.rbac.db.QueryRow(query, parentID).Scan(&parentLeft, &parentRight); err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf("SELECT id, %s, %s FROM %s WHERE %s = ?", Left, Right, table, Parent)
+	rows, err := e.rbac.db.Query(query, parentID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type span struct{ left, right int64 }
+	var children = make(map[int64]span)
+	for rows.Next() {
+		var id int64
+		var s span
+		if err := rows.Scan(&id, &s.left, &s.right); err != nil {
+			return err
+		}
+		children[id] = s
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if len(ids) != len(children) {
+		return ErrReorderChildren
+	}
+
+	var cases []string
+	var args []interface{}
+	var position = parentLeft + 1
+	var seen = make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		s, ok := children[id]
+		if !ok || seen[id] {
+			return ErrReorderChildren
+		}
+		seen[id] = true
+
+		cases = append(cases, "WHEN %s BETWEEN ? AND ? THEN ?")
+		args = append(args, s.left, s.right, position-s.left)
+		position += s.right - s.left + 1
+	}
+
+	if len(cases) == 0 {
+		return nil
+	}
+
+	// Both columns are shifted in a single statement, so subtrees never overlap
+	// halfway through. Each CASE matches on its own column because MySQL
+	// applies the assignments from left to right.
+	var when = strings.Join(cases, " ")
+	query = fmt.Sprintf("UPDATE %s SET %s = %s + CASE %s END, %s = %s + CASE %s END WHERE %s > ? AND %s < ?",
+		table,
+		Left, Left, strings.Replace(when, "%s", Left, -1),
+		Right, Right, strings.Replace(when, "%s", Right, -1),
+		Left, Right)
+
+	args = append(args, args...)
+	args = append(args, parentLeft, parentRight)
+
+	_, err = e.rbac.db.Exec(query, args...)
+	return err
+}
+
 func (e entity) titleID(title string) (int64, error) {
-	var id int64
+	return titleID(e, title)
+}
 
-	query := fmt.Sprintf("SELECT id FROM %s WHERE title=?", e.entityHolder.getTable())
-	err := e.rbac.db.QueryRow(query, title).Scan(&id)
+// titleID resolves a title to a single node. A title shared by several
+// nodes is reported as an AmbiguousTitleError listing their paths.
+func titleID(e entityInternal, title string) (int64, error) {
+	ids, err := e.titleIDs(title)
 	if err != nil {
-		if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	switch len(ids) {
+	case 0:
+		return 0, ErrTitleNotFound
+	case 1:
+		return ids[0], nil
+	}
+
+	var paths []string
+	for _, id := range ids {
+		path, err := e.getPath(id)
+		if err != nil {
 			return 0, err
 		}
-		fmt.Printf("%s", title)
-		return 0, ErrTitleNotFound
+		paths = append(paths, path)
 	}
-	return id, nil
+
+	return 0, &AmbiguousTitleError{Title: title, Paths: paths}
+}
+
+func (e entity) titleIDs(title string) ([]int64, error) {
+	query := fmt.Sprintf("SELECT id FROM %s WHERE title=? ORDER BY id", e.entityHolder.getTable())
+	rows, err := e.rbac.db.Query(query, title)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
 }
 
 func (e entity) lock() {
@@ -148,12 +362,9 @@ func (e entity) reset(ensure bool) error {
 		return err
 	}
 
-	_, err = e.rbac.db.Exec(fmt.Sprintf("ALTER TABLE %s AUTO_INCREMENT=1;", e.entityHolder.getTable()))
-	if err != nil {
-		return err
-	}
-
-	_, err = e.rbac.db.Exec(fmt.Sprintf("INSERT INTO %s (Title, Description, Lft, Rght) Values(?,?,?,?)", e.entityHolder.getTable()), "root", "root", 0, 1)
+	// IDs are not handed out again, as the audit log keeps referring to
+	// them, so the root is inserted with its fixed ID.
+	_, err = e.rbac.db.Exec(fmt.Sprintf("INSERT INTO %s (ID, Title, Description, Lft, Rght, %s, %s) Values(?,?,?,?,?,?,?)", e.entityHolder.getTable(), Parent, Depth), e.rbac.rootID(), "root", "root", 0, 1, 0, 0)
 	if err != nil {
 		return err
 	}
@@ -172,7 +383,12 @@ func (e entity) resetAssignments(ensure bool) error {
 		return err
 	}
 
-	_, err = e.rbac.db.Exec("ALTER TABLE role_permissions AUTO_INCREMENT =1")
+	_, err = e.rbac.db.Exec("DELETE FROM role_permission_patterns")
+	if err != nil {
+		return err
+	}
+
+	_, err = e.rbac.db.Exec("DELETE FROM role_resource_permissions")
 	if err != nil {
 		return err
 	}
@@ -219,6 +435,12 @@ func (e entity) pathID(path string) (int64, error) {
 }
 
 func (e entity) addPath(path string, descriptions []string) (int64, error) {
+	return addPath(e, path, descriptions)
+}
+
+// addPath creates every missing node along path. It only relies on the
+// entityInternal contract so that each hierarchy strategy can share it.
+func addPath(e entityInternal, path string, descriptions []string) (int64, error) {
 	if path[:1] != "/" {
 		return 0, fmt.Errorf("The path supplied is not valid.")
 	}
@@ -242,7 +464,7 @@ func (e entity) addPath(path string, descriptions []string) (int64, error) {
 		currentPath += "/" + part
 
 		pathID, err = e.pathID(currentPath)
-		if err != ErrPathNotFound {
+		if err != nil && err != ErrPathNotFound {
 			return nodesCreated, err
 		}
 
@@ -268,12 +490,18 @@ func (e entity) count() (int64, error) {
 }
 
 func (e entity) deleteConditional(id int64) error {
-	var left, right int64
-	query := fmt.Sprintf(`SELECT %s, %s
+	var left, right, parentID int64
+	query := fmt.Sprintf(`SELECT %s, %s, %s
 		FROM %s 
-	WHERE ID=? LIMIT 1`, Left, Right, e.entityHolder.getTable())
+	WHERE ID=? LIMIT 1`, Left, Right, Parent, e.entityHolder.getTable())
+
+	err := e.rbac.db.QueryRow(query, id).Scan(&left, &right, &parentID)
+	if err != nil {
+		return err
+	}
 
-	err := e.rbac.db.QueryRow(query, id).Scan(&left, &right)
+	// Children move up to the parent of the deleted node.
+	_, err = e.rbac.db.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", e.entityHolder.getTable(), Parent, Parent), parentID, id)
 	if err != nil {
 		return err
 	}
@@ -283,8 +511,8 @@ func (e entity) deleteConditional(id int64) error {
 		return err
 	}
 
-	query = fmt.Sprintf("UPDATE %s SET %s = %s -1, %s = %s -1 WHERE %s BETWEEN ? AND ?", e.entityHolder.getTable(), Right, Right, Left, Left, Left)
-	_, err = e.rbac.db.Query(query, left, right)
+	query = fmt.Sprintf("UPDATE %s SET %s = %s -1, %s = %s -1, %s = %s -1 WHERE %s BETWEEN ? AND ?", e.entityHolder.getTable(), Right, Right, Left, Left, Depth, Depth, Left)
+	_, err = e.rbac.db.Exec(query, left, right)
 	if err != nil {
 		return err
 	}
@@ -292,12 +520,11 @@ func (e entity) deleteConditional(id int64) error {
 	query = fmt.Sprintf("UPDATE %s SET %s = %s -2 WHERE %s > ?", e.entityHolder.getTable(), Right, Right, Right)
 	_, err = e.rbac.db.Exec(query, right)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 
 	query = fmt.Sprintf("UPDATE %s SET %s = %s -2 WHERE %s > ?", e.entityHolder.getTable(), Left, Left, Left)
-	_, err = e.rbac.db.Query(query, right)
+	_, err = e.rbac.db.Exec(query, right)
 	if err != nil {
 		return err
 	}
@@ -317,19 +544,19 @@ func (e entity) deleteSubtreeConditional(id int64) error {
 	}
 
 	query = fmt.Sprintf("DELETE FROM %s WHERE %s BETWEEN ? AND ?", e.entityHolder.getTable(), Left)
-	_, err = e.rbac.db.Query(query, right)
+	_, err = e.rbac.db.Exec(query, left, right)
 	if err != nil {
 		return err
 	}
 
 	query = fmt.Sprintf("UPDATE %s SET %s = %s - ? WHERE %s > ?", e.entityHolder.getTable(), Right, Right, Right)
-	_, err = e.rbac.db.Query(query, width, right)
+	_, err = e.rbac.db.Exec(query, width, right)
 	if err != nil {
 		return err
 	}
 
 	query = fmt.Sprintf("UPDATE %s SET %s = %s - ? WHERE %s > ?", e.entityHolder.getTable(), Left, Left, Left)
-	_, err = e.rbac.db.Query(query, width, right)
+	_, err = e.rbac.db.Exec(query, width, right)
 	if err != nil {
 		return err
 	}
@@ -358,6 +585,10 @@ func (e entity) getTitle(id int64) (string, error) {
 }
 
 func (e entity) getPath(id int64) (string, error) {
+	return getPath(e, id)
+}
+
+func getPath(e entityInternal, id int64) (string, error) {
 	res, err := e.pathConditional(id)
 	if err != nil {
 		return "", err
@@ -378,47 +609,62 @@ func (e entity) getPath(id int64) (string, error) {
 	return output, nil
 }
 
-func (e entity) pathConditional(id int64) ([]path, error) {
+func (e entity) pathConditional(id int64) ([]Node, error) {
 	query := fmt.Sprintf(`
-		SELECT parent.ID, parent.Title
+		SELECT parent.ID, parent.Title, parent.Description, parent.%s
 		FROM %s AS node,
 			%s AS parent
 		WHERE node.%s BETWEEN parent.%s AND parent.%s
 		AND ( node.id=? )
-		ORDER BY parent.%s`, e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, Left)
+		ORDER BY parent.%s`, Depth, e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, Left)
 
-	rows, err := e.rbac.db.Query(query, id)
+	return e.nodes(query, id)
+}
+
+// nodes runs a query selecting id, title, description and depth.
+func (e entity) nodes(query string, args ...interface{}) ([]Node, error) {
+	rows, err := e.rbac.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var result []path
+	var result []Node
 	for rows.Next() {
-		var id int64
-		var title string
-		err := rows.Scan(&id, &title)
+		var p Node
+		err := rows.Scan(&p.ID, &p.Title, &p.Description, &p.Depth)
 		if err != nil {
 			return nil, err
 		}
-		result = append(result, path{ID: id, Title: title})
+		result = append(result, p)
 	}
 
-	return result, nil
+	return result, rows.Err()
 }
 
 func (e entity) depth(id int64) (int64, error) {
-	res, err := e.pathConditional(id)
+	var result int64
+	err := e.rbac.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id=?", Depth, e.entityHolder.getTable()), id).Scan(&result)
 	if err != nil {
 		return 0, err
 	}
 
-	return int64(len(res) - 1), nil
+	return result, nil
 }
 
 func (e entity) edit(id int64, title, description string) error {
+	parentID, err := e.parentNode(id)
+	if err != nil {
+		return err
+	}
+	if id != e.rbac.rootID() {
+		if err := e.checkTitle(title, parentID, id); err != nil {
+			return err
+		}
+	}
+
 	query := fmt.Sprintf("UPDATE %s SET title=?, description=? WHERE id=?", e.entityHolder.getTable())
-	_, err := e.rbac.db.Exec(query, title, description, id)
+	_, err = e.rbac.db.Exec(query, title, description, id)
 	if err != nil {
 		return err
 	}
@@ -426,20 +672,88 @@ func (e entity) edit(id int64, title, description string) error {
 	return nil
 }
 
-func (e entity) parentNode(id int64) (int64, error) {
-	res, err := e.pathConditional(id)
+// rename changes the last part of path to title, keeping the description.
+func rename(e entityInternal, path, title string) error {
+	if !strings.HasPrefix(path, "/") {
+		return ErrPathNotFound
+	}
+	if strings.Trim(path, "/") == "" {
+		return ErrRenameRoot
+	}
+
+	id, err := e.pathID(path)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	if len(res) < 2 {
-		return 0, nil
+	description, err := e.getDescription(id)
+	if err != nil {
+		return err
 	}
 
-	return res[len(res)-2].ID, nil
+	return e.edit(id, title, description)
+}
+
+// checkTitle rejects titles that cannot be told apart in a path: empty
+// titles, titles containing '/' and titles already used by another child of
+// parentID, or by any other node under the UniqueTitles policy. exceptID is
+// left out of the comparison, so a node can keep its own title.
+func (e entity) checkTitle(title string, parentID, exceptID int64) error {
+	if title == "" || strings.Contains(title, "/") {
+		return ErrInvalidTitle
+	}
+
+	var count int64
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s=? AND title=? AND id<>?", e.entityHolder.getTable(), Parent)
+	if err := e.rbac.db.QueryRow(query, parentID, title, exceptID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrDuplicateTitle
+	}
+
+	if e.rbac.titles == UniqueTitles {
+		query = fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE title=? AND id<>?", e.entityHolder.getTable())
+		if err := e.rbac.db.QueryRow(query, title, exceptID).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrTitleInUse
+		}
+	}
+
+	return nil
+}
+
+// checkMove makes sure id has a unique title below its new parent. title is
+// the title id gets there, or empty to keep the current one. The resolved
+// title is returned.
+func (e entity) checkMove(id, parentID int64, title string) (string, error) {
+	if title == "" {
+		var err error
+		if title, err = e.getTitle(id); err != nil {
+			return "", err
+		}
+	}
+
+	return title, e.checkTitle(title, parentID, id)
+}
+
+func (e entity) parentNode(id int64) (int64, error) {
+	var result int64
+	err := e.rbac.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id=?", Parent, e.entityHolder.getTable()), id).Scan(&result)
+	if err != nil {
+		return 0, err
+	}
+
+	return result, nil
 }
 
 func (e entity) returnID(entity string) (int64, error) {
+	return returnID(e, entity)
+}
+
+func returnID(e entityInternal, entity string) (int64, error) {
 	var entityID int64
 	var err error
 	if entity[:1] == "/" {
@@ -451,7 +765,26 @@ func (e entity) returnID(entity string) (int64, error) {
 	return entityID, err
 }
 
-func (e entity) descendants(absolute bool, id int64) ([]path, error) {
+// subtreeIDs returns id and, when recursive, the IDs of all its descendants,
+// which are the nodes a removal deletes.
+func subtreeIDs(e entityInternal, id int64, recursive bool) ([]int64, error) {
+	var ids = []int64{id}
+	if !recursive {
+		return ids, nil
+	}
+
+	descendants, err := e.descendants(false, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range descendants {
+		ids = append(ids, d.ID)
+	}
+
+	return ids, nil
+}
+
+func (e entity) descendants(absolute bool, id int64) ([]Node, error) {
 	var depthConcat string
 	if !absolute {
 		depthConcat = "- (sub_tree.innerDepth )"
@@ -478,7 +811,7 @@ func (e entity) descendants(absolute bool, id int64) ([]path, error) {
             ORDER BY node.%s
 	`, depthConcat, e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, Left, Left, Left, Right, Left, Left, Right, Left)
 
-	var result []path
+	var result []Node
 	rows, err := e.rbac.db.Query(query, id)
 	if err != nil {
 		return nil, err
@@ -486,7 +819,7 @@ func (e entity) descendants(absolute bool, id int64) ([]path, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var p path
+		var p Node
 		err := rows.Scan(&p.ID, &p.Title, &p.Description, &p.Depth)
 		if err != nil {
 			return nil, err
@@ -497,30 +830,21 @@ func (e entity) descendants(absolute bool, id int64) ([]path, error) {
 	return result, nil
 }
 
-func (e entity) children(id int64) ([]path, error) {
+func (e entity) within(descendant, ancestor string) string {
+	return fmt.Sprintf("%s.%s BETWEEN %s.%s AND %s.%s", descendant, Left, ancestor, Left, ancestor, Right)
+}
+
+// children returns every descendant of id with its depth relative to id.
+func (e entity) children(id int64) ([]Node, error) {
+	var table = e.entityHolder.getTable()
 	query := fmt.Sprintf(`
-            SELECT node.ID, node.Title, node.Description,(COUNT(parent.ID)-1 - (sub_tree.innerDepth )) AS Depth
-            FROM %s AS node,
-            	%s AS parent,
-            	%s AS sub_parent,
-            	(
-            		SELECT node.ID, (COUNT(parent.ID) - 1) AS innerDepth
-            		FROM %s AS node,
-            		%s AS parent
-            		WHERE node.%s BETWEEN parent.%s AND parent.%s
-            		AND (node.ID=?)
-            		GROUP BY node.ID
-            		ORDER BY node.%s
-            	) AS sub_tree
-            WHERE node.%s BETWEEN parent.%s AND parent.%s
-            	AND node.%s BETWEEN sub_parent.%s AND sub_parent.%s
-            	AND sub_parent.ID = sub_tree.ID
-            GROUP BY node.ID
-            HAVING Depth > 0
-            ORDER BY node.%s
-	`, e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), e.entityHolder.getTable(), Left, Left, Right, Left, Left, Left, Right, Left, Left, Right, Left)
+		SELECT node.id, node.title, node.description, node.%s - self.%s
+		FROM %s AS node
+		JOIN %s AS self ON (self.id=?)
+		WHERE node.%s > self.%s AND node.%s < self.%s
+		ORDER BY node.%s`, Depth, Depth, table, table, Left, Left, Left, Right, Left)
 
-	var result []path
+	var result []Node
 	rows, err := e.rbac.db.Query(query, id)
 	if err != nil {
 		return nil, err
@@ -528,7 +852,7 @@ func (e entity) children(id int64) ([]path, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var p path
+		var p Node
 		err := rows.Scan(&p.ID, &p.Title, &p.Description, &p.Depth)
 		if err != nil {
 			return nil, err
@@ -537,5 +861,120 @@ func (e entity) children(id int64) ([]path, error) {
 	}
 
 	return result, nil
+}
+
+func (e entity) siblings(id int64) ([]Node, error) {
+	var table = e.entityHolder.getTable()
+	query := fmt.Sprintf(`
+		SELECT node.id, node.title, node.description, node.%s
+		FROM %s AS node
+		JOIN %s AS self ON (self.id=?)
+		WHERE node.%s = self.%s AND node.id <> self.id
+		ORDER BY node.%s, node.id`, Depth, table, table, Parent, Parent, Left)
+
+	return e.nodes(query, id)
+}
+
+func (e entity) leaves(id int64) ([]Node, error) {
+	var table = e.entityHolder.getTable()
+	query := fmt.Sprintf(`
+		SELECT node.id, node.title, node.description, node.%s
+		FROM %s AS node
+		JOIN %s AS top ON (top.id=?)
+		WHERE %s AND node.%s = node.%s + 1
+		ORDER BY node.%s`, Depth, table, table, e.within("node", "top"), Right, Left, Left)
+
+	return e.nodes(query, id)
+}
+
+func (e entity) subtreeSize(id int64) (int64, error) {
+	var result int64
+	err := e.rbac.db.QueryRow(fmt.Sprintf("SELECT (%s - %s + 1) DIV 2 FROM %s WHERE id=?", Right, Left, e.entityHolder.getTable()), id).Scan(&result)
+	if err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// move relocates the subtree of id to become the last child of parentID,
+// titled title, or keeping its title when title is empty.
+// IDs are preserved, so assignments stay intact.
+func (e entity) move(id int64, parentID int64, title string) error {
+	if parentID == 0 {
+		parentID = e.rbac.rootID()
+	}
+	if id == e.rbac.rootID() {
+		return ErrMoveRoot
+	}
+
+	var left, right, depth, parentLeft, parentRight, parentDepth int64
+	query := fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE id=?", Left, Right, Depth, e.entityHolder.getTable())
+
+	err := e.rbac.db.QueryRow(query, id).Scan(&left, &right, &depth)
+	if err != nil {
+		return err
+	}
+
+	err = e.rbac.db.QueryRow(query, parentID).Scan(&parentLeft, &parentRight, &parentDepth)
+	if err != nil {
+		return err
+	}
+
+	if parentLeft >= left && parentLeft <= right {
+		return ErrMoveIntoSelf
+	}
+
+	title, err = e.checkMove(id, parentID, title)
+	if err != nil {
+		return err
+	}
 
+	var width = right - left + 1
+	var table = e.entityHolder.getTable()
+
+	// Park the subtree on negative values while the rest of the tree is shifted.
+	_, err = e.rbac.db.Exec(fmt.Sprintf("UPDATE %s SET %s = -%s, %s = -%s WHERE %s BETWEEN ? AND ?", table, Left, Left, Right, Right, Left), left, right)
+	if err != nil {
+		return err
+	}
+
+	// Close the gap left behind.
+	_, err = e.rbac.db.Exec(fmt.Sprintf("UPDATE %s SET %s = %s - ? WHERE %s > ?", table, Left, Left, Left), width, right)
+	if err != nil {
+		return err
+	}
+	_, err = e.rbac.db.Exec(fmt.Sprintf("UPDATE %s SET %s = %s - ? WHERE %s > ?", table, Right, Right, Right), width, right)
+	if err != nil {
+		return err
+	}
+
+	// The parent may have shifted, so read its right value again.
+	err = e.rbac.db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id=?", Right, table), parentID).Scan(&parentRight)
+	if err != nil {
+		return err
+	}
+
+	// Open a gap at the end of the new parent.
+	_, err = e.rbac.db.Exec(fmt.Sprintf("UPDATE %s SET %s = %s + ? WHERE %s >= ?", table, Left, Left, Left), width, parentRight)
+	if err != nil {
+		return err
+	}
+	_, err = e.rbac.db.Exec(fmt.Sprintf("UPDATE %s SET %s = %s + ? WHERE %s >= ?", table, Right, Right, Right), width, parentRight)
+	if err != nil {
+		return err
+	}
+
+	// Drop the parked subtree into the gap.
+	_, err = e.rbac.db.Exec(fmt.Sprintf("UPDATE %s SET %s = ? - %s, %s = ? - %s, %s = %s + ? WHERE %s < 0", table, Left, Left, Right, Right, Depth, Depth, Left), parentRight-left, parentRight-left, parentDepth+1-depth)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.rbac.db.Exec(fmt.Sprintf("UPDATE %s SET %s = ?, title = ? WHERE id=?", table, Parent), parentID, title, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
@@ -0,0 +1,355 @@
+package gorbac
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyFormat selects the serialization used by Export.
+type PolicyFormat string
+
+// Supported policy formats
+const (
+	FormatJSON PolicyFormat = "json"
+	FormatYAML PolicyFormat = "yaml"
+)
+
+// Export writes the role tree, the permission tree, all role-permission grants,
+// the resource grants, the inheritance edges and the owner assignments of
+// every registered extension to writer.
+// The output is deterministic and can be read back with Import. Assignments
+// created by Reset, and assignments pointing at nodes that no longer exist,
+// are left out, so a dump imports cleanly into a reset database.
+func (r Rbac) Export(writer io.Writer, format PolicyFormat) error {
+	policy, err := r.Dump()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(policy)
+	case FormatYAML:
+		encoder := yaml.NewEncoder(writer)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(policy); err != nil {
+			return err
+		}
+		return encoder.Close()
+	}
+
+	return fmt.Errorf("unknown policy format: %v", format)
+}
+
+// Dump returns the current database contents as a policy document.
+func (r Rbac) Dump() (*Policy, error) {
+	snapshot, err := r.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot.policy, nil
+}
+
+// snapshot is a dump together with the IDs behind each role and permission path.
+type snapshot struct {
+	policy        *Policy
+	roleIDs       map[string]int64
+	permissionIDs map[string]int64
+}
+
+func (r Rbac) snapshot() (*snapshot, error) {
+	var policy = &Policy{
+		Roles:       []PolicyNode{},
+		Permissions: []PolicyNode{},
+		Grants:      []PolicyGrant{},
+	}
+
+	rolePaths, err := r.exportTree(r.roles.entity, &policy.Roles)
+	if err != nil {
+		return nil, err
+	}
+
+	permissionPaths, err := r.exportTree(r.permissions.entity, &policy.Permissions)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query("SELECT role_id, permission_id, deny, condition_expr, valid_from, valid_until FROM role_permissions")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roleID, permissionID int64
+		var deny bool
+		var condition Condition
+		var from, until sql.NullTime
+		if err := rows.Scan(&roleID, &permissionID, &deny, &condition, &from, &until); err != nil {
+			return nil, err
+		}
+		if roleID == r.rootID() && permissionID == r.rootID() {
+			continue
+		}
+
+		role, ok := rolePaths[roleID]
+		if !ok {
+			continue
+		}
+		permission, ok := permissionPaths[permissionID]
+		if !ok {
+			continue
+		}
+		policy.Grants = append(policy.Grants, PolicyGrant{Role: role, Permission: permission, Deny: deny, Condition: condition, ValidFrom: timePointer(from), ValidUntil: timePointer(until)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	patterns, err := r.db.Query("SELECT role_id, pattern, condition_expr, valid_from, valid_until FROM role_permission_patterns")
+	if err != nil {
+		return nil, err
+	}
+	defer patterns.Close()
+
+	for patterns.Next() {
+		var roleID int64
+		var pattern string
+		var condition Condition
+		var from, until sql.NullTime
+		if err := patterns.Scan(&roleID, &pattern, &condition, &from, &until); err != nil {
+			return nil, err
+		}
+
+		role, ok := rolePaths[roleID]
+		if !ok {
+			continue
+		}
+		policy.Grants = append(policy.Grants, PolicyGrant{Role: role, Permission: pattern, Condition: condition, ValidFrom: timePointer(from), ValidUntil: timePointer(until)})
+	}
+	if err := patterns.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(policy.Grants, func(i, j int) bool {
+		if policy.Grants[i].Role != policy.Grants[j].Role {
+			return policy.Grants[i].Role < policy.Grants[j].Role
+		}
+		return policy.Grants[i].Permission < policy.Grants[j].Permission
+	})
+
+	if err := r.exportResources(policy, rolePaths, permissionPaths); err != nil {
+		return nil, err
+	}
+
+	edges, err := r.db.Query("SELECT senior_id, junior_id FROM role_inheritance")
+	if err != nil {
+		return nil, err
+	}
+	defer edges.Close()
+
+	for edges.Next() {
+		var seniorID, juniorID int64
+		if err := edges.Scan(&seniorID, &juniorID); err != nil {
+			return nil, err
+		}
+
+		senior, ok := rolePaths[seniorID]
+		if !ok {
+			continue
+		}
+		junior, ok := rolePaths[juniorID]
+		if !ok {
+			continue
+		}
+		policy.Inheritance = append(policy.Inheritance, PolicyInheritance{Senior: senior, Junior: junior})
+	}
+	if err := edges.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(policy.Inheritance, func(i, j int) bool {
+		if policy.Inheritance[i].Senior != policy.Inheritance[j].Senior {
+			return policy.Inheritance[i].Senior < policy.Inheritance[j].Senior
+		}
+		return policy.Inheritance[i].Junior < policy.Inheritance[j].Junior
+	})
+
+	var names []string
+	for name := range r.extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		owners, err := r.exportOwners(name, rolePaths)
+		if err != nil {
+			return nil, err
+		}
+		policy.Owners = append(policy.Owners, owners...)
+	}
+
+	return &snapshot{policy: policy, roleIDs: invertPaths(rolePaths), permissionIDs: invertPaths(permissionPaths)}, nil
+}
+
+func invertPaths(paths map[int64]string) map[string]int64 {
+	var ids = make(map[string]int64, len(paths))
+	for id, path := range paths {
+		ids[path] = id
+	}
+	return ids
+}
+
+// exportTree appends every node below root to nodes in nested-set order and
+// returns the full path of each node by ID.
+func (r Rbac) exportTree(e entityInternal, nodes *[]PolicyNode) (map[int64]string, error) {
+	descendants, err := e.descendants(true, r.rootID())
+	if err != nil {
+		return nil, err
+	}
+
+	var paths = map[int64]string{r.rootID(): "/"}
+	var parts []string
+
+	for _, d := range descendants {
+		parts = append(parts[:d.Depth-1], d.Title)
+		paths[d.ID] = "/" + strings.Join(parts, "/")
+		*nodes = append(*nodes, PolicyNode{Path: paths[d.ID], Description: d.Description})
+	}
+
+	return paths, nil
+}
+
+// exportResources appends the role and user resource grants to policy.
+func (r Rbac) exportResources(policy *Policy, rolePaths, permissionPaths map[int64]string) error {
+	rows, err := r.db.Query(`
+		SELECT role_id, '', permission_id, resource_type, resource_id FROM role_resource_permissions
+		UNION ALL
+		SELECT 0, user_id, permission_id, resource_type, resource_id FROM user_resource_permissions`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roleID, permissionID int64
+		var resource PolicyResource
+		if err := rows.Scan(&roleID, &resource.User, &permissionID, &resource.ResourceType, &resource.ResourceID); err != nil {
+			return err
+		}
+
+		var ok bool
+		if resource.User == "" {
+			if resource.Role, ok = rolePaths[roleID]; !ok {
+				continue
+			}
+		}
+		if resource.Permission, ok = permissionPaths[permissionID]; !ok {
+			continue
+		}
+		policy.Resources = append(policy.Resources, resource)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sort.Slice(policy.Resources, func(i, j int) bool {
+		a, b := policy.Resources[i], policy.Resources[j]
+		if a.Role != b.Role {
+			return a.Role < b.Role
+		}
+		if a.User != b.User {
+			return lessOwner(a.User, b.User)
+		}
+		if a.Permission != b.Permission {
+			return a.Permission < b.Permission
+		}
+		if a.ResourceType != b.ResourceType {
+			return a.ResourceType < b.ResourceType
+		}
+		return a.ResourceID < b.ResourceID
+	})
+
+	return nil
+}
+
+func (r Rbac) exportOwners(name string, rolePaths map[int64]string) ([]PolicyOwner, error) {
+	// Only the built-in Users store conditions and validity windows; other
+	// extensions may not have the columns.
+	var columns = "'', NULL, NULL"
+	if _, ok := r.extensions[name].(Users); ok {
+		columns = "condition_expr, valid_from, valid_until"
+	}
+
+	rows, err := r.db.Query(fmt.Sprintf("SELECT user_id, role_id, %s FROM %s", columns, r.extensions[name].Table()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var owners []PolicyOwner
+	for rows.Next() {
+		var owner string
+		var roleID int64
+		var condition Condition
+		var from, until sql.NullTime
+		if err := rows.Scan(&owner, &roleID, &condition, &from, &until); err != nil {
+			return nil, err
+		}
+		if name == "users" && roleID == r.rootID() && owner == strconv.FormatInt(r.rootID(), 10) {
+			continue
+		}
+
+		role, ok := rolePaths[roleID]
+		if !ok {
+			continue
+		}
+
+		var extension string
+		if name != "users" {
+			extension = name
+		}
+		owners = append(owners, PolicyOwner{Extension: extension, Owner: owner, Role: role, Condition: condition, ValidFrom: timePointer(from), ValidUntil: timePointer(until)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(owners, func(i, j int) bool {
+		if owners[i].Owner != owners[j].Owner {
+			return lessOwner(owners[i].Owner, owners[j].Owner)
+		}
+		return owners[i].Role < owners[j].Role
+	})
+
+	return owners, nil
+}
+
+// lessOwner orders numeric owners numerically and everything else lexically.
+func lessOwner(a, b string) bool {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	if errA == nil && errB == nil {
+		return x < y
+	}
+	return a < b
+}
+
+func timePointer(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	var utc = t.Time.UTC()
+	return &utc
+}
@@ -0,0 +1,176 @@
+package gorbac
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrInheritanceCycle is returned when an inheritance edge would make a role
+// inherit from itself.
+var ErrInheritanceCycle = errors.New("inheritance would create a cycle")
+
+// AddInheritance lets senior inherit everything junior has, on top of what it
+// inherits from its descendants in the role tree. A role can have any number
+// of juniors and seniors, as long as no cycle is formed and no user ends up
+// breaking a separation of duty constraint.
+func (r Roles) AddInheritance(senior RoleInterface, junior RoleInterface) error {
+	seniorID, err := r.GetRoleID(senior)
+	if err != nil {
+		return err
+	}
+
+	juniorID, err := r.GetRoleID(junior)
+	if err != nil {
+		return err
+	}
+
+	return r.rbac.auditedEdge(KindInheritance, ActionAssign, seniorID, juniorID, func(tx *Rbac) (bool, error) {
+		return true, tx.Constraints().guard(seniorID, func(tx *Rbac) error {
+			reachable, err := tx.roles.expand([]int64{juniorID})
+			if err != nil {
+				return err
+			}
+			for _, id := range reachable {
+				if id == seniorID {
+					return ErrInheritanceCycle
+				}
+			}
+
+			_, err = tx.db.Exec("INSERT INTO role_inheritance (senior_id, junior_id) VALUES(?,?)", seniorID, juniorID)
+			return err
+		})
+	})
+}
+
+// RemoveInheritance deletes an inheritance edge added by AddInheritance.
+func (r Roles) RemoveInheritance(senior RoleInterface, junior RoleInterface) error {
+	seniorID, err := r.GetRoleID(senior)
+	if err != nil {
+		return err
+	}
+
+	juniorID, err := r.GetRoleID(junior)
+	if err != nil {
+		return err
+	}
+
+	return r.rbac.auditedEdge(KindInheritance, ActionUnassign, seniorID, juniorID, func(tx *Rbac) (bool, error) {
+		return tx.deleteRows("DELETE FROM role_inheritance WHERE senior_id=? AND junior_id=?", seniorID, juniorID)
+	})
+}
+
+// Juniors returns the roles a role inherits from directly through inheritance edges.
+func (r Roles) Juniors(role RoleInterface) ([]Role, error) {
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.rbac.db.Query(`
+		SELECT TR.ID, TR.Title, TR.Description
+		FROM role_inheritance AS TI
+		JOIN roles AS TR ON (TR.ID = TI.junior_id)
+		WHERE TI.senior_id=? ORDER BY TR.ID`, roleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.Title, &role.Description); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+func (r Roles) removeInheritance(roleID int64) error {
+	_, err := r.rbac.db.Exec("DELETE FROM role_inheritance WHERE senior_id=? OR junior_id=?", roleID, roleID)
+	return err
+}
+
+// coverage returns a WITH RECURSIVE clause defining the table
+// covered(id, origin): the given roles, their descendants in the role tree
+// and, transitively, everything reachable through inheritance edges, along
+// with the given role each was reached from. A role reached from several
+// given roles appears once for each. The closure is resolved by the
+// database, so only the given IDs are sent along, and UNION keeps
+// inheritance cycles from recursing forever. Recursive CTEs need MySQL 8.0.
+func (r Roles) coverage(roleIDs []int64) (string, []interface{}) {
+	query := fmt.Sprintf(`WITH RECURSIVE covered (id, origin) AS (
+		SELECT ID, ID FROM roles WHERE ID IN (%s)
+		UNION
+		SELECT TR.ID, covered.origin FROM covered
+		JOIN roles AS TRdirect ON (TRdirect.ID = covered.id)
+		JOIN roles AS TR ON (%s)
+		UNION
+		SELECT TI.junior_id, covered.origin FROM covered
+		JOIN role_inheritance AS TI ON (TI.senior_id = covered.id)
+	)`, placeholders(len(roleIDs)), r.entity.within("TR", "TRdirect"))
+
+	return query, int64Args(roleIDs)
+}
+
+// coverers returns a WITH RECURSIVE clause defining the table coverers(id):
+// every role that covers roleID, which is the reverse of coverage.
+func (r Roles) coverers(roleID int64) (string, []interface{}) {
+	query := fmt.Sprintf(`WITH RECURSIVE coverers (id) AS (
+		SELECT ID FROM roles WHERE ID=?
+		UNION
+		SELECT TR.ID FROM coverers
+		JOIN roles AS TRdirect ON (TRdirect.ID = coverers.id)
+		JOIN roles AS TR ON (%s)
+		UNION
+		SELECT TI.senior_id FROM coverers
+		JOIN role_inheritance AS TI ON (TI.junior_id = coverers.id)
+	)`, r.entity.within("TRdirect", "TR"))
+
+	return query, []interface{}{roleID}
+}
+
+// expand returns every role that the given roles cover, sorted.
+func (r Roles) expand(roleIDs []int64) ([]int64, error) {
+	if len(roleIDs) == 0 {
+		return nil, nil
+	}
+
+	cte, args := r.coverage(roleIDs)
+	rows, err := r.rbac.db.Query(cte+" SELECT DISTINCT id FROM covered ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		result = append(result, id)
+	}
+
+	return result, rows.Err()
+}
+
+// covering returns the first of the given roles that covers roleID, or 0
+// when none does.
+func (r Roles) covering(roleIDs []int64, roleID int64) (int64, error) {
+	if len(roleIDs) == 0 {
+		return 0, nil
+	}
+
+	cte, args := r.coverage(roleIDs)
+	var origin int64
+	err := r.rbac.db.QueryRow(cte+" SELECT origin FROM covered WHERE id=? ORDER BY origin LIMIT 1", append(args, roleID)...).Scan(&origin)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return origin, err
+}
@@ -0,0 +1,257 @@
+package gorbac
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ProblemKind classifies an inconsistency found by Verify.
+type ProblemKind string
+
+// Nested set problems
+const (
+	ProblemMissingRoot ProblemKind = "missing root"
+	ProblemRange       ProblemKind = "left not below right"
+	ProblemGap         ProblemKind = "gap"
+	ProblemDuplicate   ProblemKind = "duplicate value"
+	ProblemOverlap     ProblemKind = "overlap"
+	ProblemOrphan      ProblemKind = "orphan"
+	ProblemParent      ProblemKind = "parent mismatch"
+	ProblemDepth       ProblemKind = "depth mismatch"
+	ProblemClosure     ProblemKind = "closure mismatch"
+)
+
+// TreeProblem describes a single inconsistency in a nested set.
+type TreeProblem struct {
+	Kind   ProblemKind
+	ID     int64
+	Detail string
+}
+
+func (p TreeProblem) String() string {
+	if p.ID == 0 {
+		return fmt.Sprintf("%s: %s", p.Kind, p.Detail)
+	}
+	return fmt.Sprintf("%s (id %d): %s", p.Kind, p.ID, p.Detail)
+}
+
+type nestedNode struct {
+	id     int64
+	left   int64
+	right  int64
+	parent int64
+	depth  int64
+}
+
+func (e entity) nestedNodes() ([]nestedNode, error) {
+	query := fmt.Sprintf("SELECT id, %s, %s, %s, %s FROM %s ORDER BY %s, id", Left, Right, Parent, Depth, e.entityHolder.getTable(), Left)
+	rows, err := e.rbac.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []nestedNode
+	for rows.Next() {
+		var n nestedNode
+		if err := rows.Scan(&n.id, &n.left, &n.right, &n.parent, &n.depth); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+
+	return nodes, rows.Err()
+}
+
+// verify reports every inconsistency in the nested set. An empty result
+// means the tree is sound.
+func (e entity) verify() ([]TreeProblem, error) {
+	nodes, err := e.nestedNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []TreeProblem
+
+	var root *nestedNode
+	for i := range nodes {
+		if nodes[i].id == e.rbac.rootID() {
+			root = &nodes[i]
+		}
+	}
+	if root == nil {
+		problems = append(problems, TreeProblem{Kind: ProblemMissingRoot, Detail: fmt.Sprintf("no node with id %d", e.rbac.rootID())})
+	}
+
+	// Every value from 0 to 2n-1 has to be used exactly once.
+	var used = make(map[int64]int64, len(nodes)*2)
+	for _, n := range nodes {
+		if n.left >= n.right {
+			problems = append(problems, TreeProblem{Kind: ProblemRange, ID: n.id, Detail: fmt.Sprintf("%s=%d, %s=%d", Left, n.left, Right, n.right)})
+		}
+		for _, value := range []int64{n.left, n.right} {
+			if other, ok := used[value]; ok {
+				problems = append(problems, TreeProblem{Kind: ProblemDuplicate, ID: n.id, Detail: fmt.Sprintf("value %d is also used by id %d", value, other)})
+				continue
+			}
+			used[value] = n.id
+		}
+	}
+	for value := int64(0); value < int64(len(nodes)*2); value++ {
+		if _, ok := used[value]; !ok {
+			problems = append(problems, TreeProblem{Kind: ProblemGap, Detail: fmt.Sprintf("value %d is not used", value)})
+		}
+	}
+
+	// Intervals have to nest: walking in left order, a node must end before
+	// the node that contains its start. That node is also its parent.
+	var stack []nestedNode
+	for _, n := range nodes {
+		for len(stack) > 0 && stack[len(stack)-1].right < n.left {
+			stack = stack[:len(stack)-1]
+		}
+
+		var parentID, depth int64
+		if len(stack) > 0 {
+			parentID = stack[len(stack)-1].id
+			depth = int64(len(stack))
+			if stack[len(stack)-1].right < n.right {
+				problems = append(problems, TreeProblem{Kind: ProblemOverlap, ID: n.id, Detail: fmt.Sprintf("partially overlaps id %d", parentID)})
+			}
+		}
+		if n.parent != parentID {
+			problems = append(problems, TreeProblem{Kind: ProblemParent, ID: n.id, Detail: fmt.Sprintf("%s is %d, nested set says %d", Parent, n.parent, parentID)})
+		}
+		if n.depth != depth {
+			problems = append(problems, TreeProblem{Kind: ProblemDepth, ID: n.id, Detail: fmt.Sprintf("%s is %d, nested set says %d", Depth, n.depth, depth)})
+		}
+		stack = append(stack, n)
+	}
+
+	if root != nil {
+		for _, n := range nodes {
+			if n.id != root.id && (n.left <= root.left || n.right >= root.right) {
+				problems = append(problems, TreeProblem{Kind: ProblemOrphan, ID: n.id, Detail: "not below the root"})
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// rebuild recomputes every left, right and depth value from the parent
+// pointers. Nodes whose parent is missing, or that are caught in a parent
+// cycle, are attached to the root, which is created when missing. Siblings
+// keep their current order.
+func (e entity) rebuild() error {
+	nodes, err := e.nestedNodes()
+	if err != nil {
+		return err
+	}
+
+	children, hasRoot := attachTree(e.rbac.rootID(), nodes)
+
+	return e.writeNestedSet(e.rbac.rootID(), children, !hasRoot)
+}
+
+// attachTree turns the parent pointers of nodes into a children map rooted
+// at rootID, repairing missing parents and cycles on the way. It also reports
+// whether the root itself exists.
+func attachTree(rootID int64, nodes []nestedNode) (map[int64][]int64, bool) {
+	var exists = make(map[int64]bool, len(nodes))
+	for _, n := range nodes {
+		exists[n.id] = true
+	}
+
+	var parents = make(map[int64]int64, len(nodes))
+	var children = make(map[int64][]int64)
+	for _, n := range nodes {
+		if n.id == rootID {
+			continue
+		}
+
+		var parentID = n.parent
+		if !exists[parentID] || parentID == n.id {
+			parentID = rootID
+		}
+		parents[n.id] = parentID
+		children[parentID] = append(children[parentID], n.id)
+	}
+
+	var reachable = make(map[int64]bool, len(nodes))
+	var mark func(id int64)
+	mark = func(id int64) {
+		reachable[id] = true
+		for _, child := range children[id] {
+			if !reachable[child] {
+				mark(child)
+			}
+		}
+	}
+	mark(rootID)
+
+	// Whatever is left hangs in a cycle. Cutting one node loose and putting it
+	// below the root breaks the cycle and brings the rest along.
+	for _, n := range nodes {
+		if reachable[n.id] {
+			continue
+		}
+
+		var siblings = children[parents[n.id]]
+		for i, id := range siblings {
+			if id == n.id {
+				children[parents[n.id]] = append(siblings[:i:i], siblings[i+1:]...)
+				break
+			}
+		}
+		children[rootID] = append(children[rootID], n.id)
+		mark(n.id)
+	}
+
+	return children, exists[rootID]
+}
+
+// writeNestedSet numbers the tree described by children depth first,
+// keeping the sibling order of each children slice, and stores the parent
+// and depth of every node along with it.
+func (e entity) writeNestedSet(rootID int64, children map[int64][]int64, createRoot bool) error {
+	var table = e.entityHolder.getTable()
+
+	if createRoot {
+		_, err := e.rbac.db.Exec(fmt.Sprintf("INSERT INTO %s (id, title, description, %s, %s, %s, %s) VALUES (?,?,?,?,?,?,?)", table, Left, Right, Parent, Depth), rootID, "root", "root", 0, 1, 0, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	var values = make(map[int64]nestedNode)
+	var counter int64
+	var walk func(id, parentID, depth int64)
+	walk = func(id, parentID, depth int64) {
+		var n = nestedNode{id: id, left: counter, parent: parentID, depth: depth}
+		counter++
+		for _, child := range children[id] {
+			walk(child, id, depth+1)
+		}
+		n.right = counter
+		counter++
+		values[id] = n
+	}
+	walk(rootID, 0, 0)
+
+	var ids []int64
+	for id := range values {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	query := fmt.Sprintf("UPDATE %s SET %s = ?, %s = ?, %s = ?, %s = ? WHERE id=?", table, Left, Right, Parent, Depth)
+	for _, id := range ids {
+		n := values[id]
+		if _, err := e.rbac.db.Exec(query, n.left, n.right, n.parent, n.depth, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
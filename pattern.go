@@ -0,0 +1,161 @@
+package gorbac
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrInvalidPattern is returned for a permission pattern that cannot be matched.
+var ErrInvalidPattern = errors.New("invalid permission pattern")
+
+// A permission pattern is a path in which segments may contain the '*', '?'
+// and '[...]' wildcards of path.Match. A segment of "**" matches any number
+// of segments, including none. Like a grant on a node, a pattern grant also
+// covers everything below the permissions it matches, so "/projects/*/read"
+// grants "/projects/web/read/issues" and "/billing/**" grants "/billing" and
+// all of its descendants.
+func isPattern(permission PermissionInterface) bool {
+	pattern, ok := permission.(string)
+	return ok && strings.ContainsAny(pattern, "*?[")
+}
+
+func validPattern(pattern string) bool {
+	if !strings.HasPrefix(pattern, "/") {
+		return false
+	}
+
+	for _, segment := range strings.Split(pattern[1:], "/") {
+		if segment == "" {
+			return false
+		}
+		if segment == "**" {
+			continue
+		}
+		if strings.Contains(segment, "**") {
+			return false
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchDepth returns the depth of the shortest of permissionPath and its
+// ancestors that matches pattern, or -1 when none does.
+func matchDepth(pattern, permissionPath string) int64 {
+	var patternSegments, segments = splitPath(pattern), splitPath(permissionPath)
+	for i := 0; i <= len(segments); i++ {
+		if matchSegments(patternSegments, segments[:i]) {
+			return int64(i)
+		}
+	}
+	return -1
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+
+	return matchSegments(pattern[1:], segments[1:])
+}
+
+func (r Rbac) assignPattern(roleID int64, pattern string, options AssignmentOptions) (int64, error) {
+	if !validPattern(pattern) {
+		return 0, ErrInvalidPattern
+	}
+
+	res, err := r.db.Exec("INSERT INTO role_permission_patterns (role_id, pattern, condition_expr, valid_from, valid_until, assignment_date) VALUES(?,?,?,?,?,?)", roleID, pattern, options.Condition, nullTime(options.ValidFrom), nullTime(options.ValidUntil), time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	insertID, _ := res.LastInsertId()
+
+	return insertID, nil
+}
+
+func (r Rbac) unassignPattern(roleID int64, pattern string) error {
+	_, err := r.db.Exec("DELETE FROM role_permission_patterns WHERE role_id=? AND pattern=?", roleID, pattern)
+	return err
+}
+
+// patternDepth returns the depth of the deepest permission matched by an
+// active pattern of the roles whose condition holds, or -1 when none matches,
+// along with the given role the pattern was reached from. A pattern weighs
+// the same as a grant on the permission it matches, so "/billing/**" weighs
+// the same as a grant on "/billing", and a deny on a deeper permission still
+// wins over it.
+func (r Rbac) patternDepth(roleIDs []int64, permissionID int64, attrs Attributes) (int64, int64, error) {
+	cte, args := r.roles.coverage(roleIDs)
+	query := fmt.Sprintf("%s SELECT pattern, condition_expr, covered.origin FROM role_permission_patterns AS TRel JOIN covered ON (covered.id=TRel.role_id) WHERE %s ORDER BY covered.origin", cte, active("TRel"))
+	rows, err := r.db.Query(query, append(args, activeArgs()...)...)
+	if err != nil {
+		return -1, 0, err
+	}
+	defer rows.Close()
+
+	var patterns []string
+	var origins []int64
+	for rows.Next() {
+		var pattern string
+		var condition Condition
+		var origin int64
+		if err := rows.Scan(&pattern, &condition, &origin); err != nil {
+			return -1, 0, err
+		}
+		if condition.holds(attrs) {
+			patterns = append(patterns, pattern)
+			origins = append(origins, origin)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return -1, 0, err
+	}
+	if len(patterns) == 0 {
+		return -1, 0, nil
+	}
+
+	permissionPath, err := r.permissions.GetPath(permissionID)
+	if err != nil {
+		return -1, 0, err
+	}
+
+	var depth, origin int64 = -1, 0
+	for i, pattern := range patterns {
+		if matched := matchDepth(pattern, permissionPath); matched > depth {
+			depth, origin = matched, origins[i]
+		}
+	}
+
+	return depth, origin, nil
+}
@@ -0,0 +1,27 @@
+package gorbac
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchDepth(t *testing.T) {
+	cases := []struct {
+		pattern, path string
+		depth         int64
+	}{
+		{"/projects/*/read", "/projects/web/read", 3},
+		{"/projects/*/read", "/projects/web/read/issues", 3},
+		{"/projects/*/read", "/projects/web/write", -1},
+		{"/billing/**", "/billing", 1},
+		{"/billing/**", "/billing/invoices/send", 1},
+		{"/**/appeal", "/forum/ban/appeal", 3},
+		{"/**", "/forum", 0},
+		{"/projects/we?/[rw]*", "/projects/web/write", 3},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.depth, matchDepth(c.pattern, c.path), c.pattern+" "+c.path)
+	}
+}
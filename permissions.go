@@ -1,5 +1,7 @@
 package gorbac
 
+import "database/sql"
+
 type Permissions struct {
 	rbac   *Rbac
 	entity entityInternal
@@ -13,13 +15,14 @@ type permission struct {
 	ID          int64
 	Title       string
 	Description string
+	Deny        bool
 }
 
 func newPermissions(r *Rbac) *Permissions {
 	var permissions = new(Permissions)
 	permissions.table = "permissions"
 	permissions.rbac = r
-	permissions.entity = &entity{rbac: r, entityHolder: permissions}
+	permissions.entity = newEntity(r, permissions)
 	return permissions
 }
 
@@ -31,8 +34,147 @@ func (p Permissions) Unassign(role RoleInterface, permission PermissionInterface
 	return p.entity.unassign(role, permission)
 }
 
+// Remove Permissions from system.
+// If set to true, all descendants of the Permission will also be removed.
+func (p Permissions) Remove(permission PermissionInterface, recursive bool) error {
+	var err error
+	var permissionID int64
+
+	permissionID, err = p.GetPermissionID(permission)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.rbac.auditedNode(KindPermission, ActionRemove, permissionID, func(tx *Rbac) (int64, error) {
+		permissionIDs, err := subtreeIDs(tx.permissions.entity, permissionID, recursive)
+		if err != nil {
+			return 0, err
+		}
+		for _, id := range permissionIDs {
+			if err := tx.permissions.UnassignRoles(id); err != nil {
+				return 0, err
+			}
+		}
+
+		if recursive {
+			return permissionID, tx.permissions.entity.deleteSubtreeConditional(permissionID)
+		}
+
+		return permissionID, tx.permissions.entity.deleteConditional(permissionID)
+	})
+	return err
+}
+
+// Rename gives the Permission at path a new title. The title has to be unique
+// among its siblings, so the renamed path cannot clash with an existing one.
+func (p Permissions) Rename(path string, title string) error {
+	id, err := p.GetPermissionID(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.rbac.auditedNode(KindPermission, ActionRename, id, func(tx *Rbac) (int64, error) {
+		return id, rename(tx.permissions.entity, path, title)
+	})
+	return err
+}
+
+// Move relocates a Permission and its descendants below a new parent.
+// IDs and assignments are kept. A Permission cannot be moved below itself.
+func (p Permissions) Move(permission PermissionInterface, parent PermissionInterface) error {
+	permissionID, err := p.GetPermissionID(permission)
+	if err != nil {
+		return err
+	}
+
+	parentID, err := p.GetPermissionID(parent)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.rbac.auditedNode(KindPermission, ActionMove, permissionID, func(tx *Rbac) (int64, error) {
+		return permissionID, tx.permissions.entity.move(permissionID, parentID, "")
+	})
+	return err
+}
+
+// InsertBefore adds a Permission as the sibling directly before another Permission.
+func (p Permissions) InsertBefore(title string, description string, sibling PermissionInterface) (int64, error) {
+	siblingID, err := p.GetPermissionID(sibling)
+	if err != nil {
+		return 0, err
+	}
+
+	return p.rbac.auditedNode(KindPermission, ActionAdd, 0, func(tx *Rbac) (int64, error) {
+		return tx.permissions.entity.insertBefore(title, description, siblingID)
+	})
+}
+
+// InsertAfter adds a Permission as the sibling directly after another Permission.
+func (p Permissions) InsertAfter(title string, description string, sibling PermissionInterface) (int64, error) {
+	siblingID, err := p.GetPermissionID(sibling)
+	if err != nil {
+		return 0, err
+	}
+
+	return p.rbac.auditedNode(KindPermission, ActionAdd, 0, func(tx *Rbac) (int64, error) {
+		return tx.permissions.entity.insertAfter(title, description, siblingID)
+	})
+}
+
+// Reorder arranges the children of a Permission in the order of ids.
+// Every child has to be listed exactly once.
+func (p Permissions) Reorder(parent PermissionInterface, ids []int64) error {
+	parentID, err := p.GetPermissionID(parent)
+	if err != nil {
+		return err
+	}
+
+	return p.rbac.reorderTree(KindPermission, parentID, ids)
+}
+
+// Verify checks the nested set of the permission tree and returns every problem found.
+func (p Permissions) Verify() ([]TreeProblem, error) {
+	return p.entity.verify()
+}
+
+// Rebuild recomputes the nested set of the permission tree. IDs and assignments are kept.
+func (p Permissions) Rebuild() error {
+	return p.rbac.rebuildTree(KindPermission)
+}
+
+// UnassignRoles removes all Role assignments of a Permission.
+func (p Permissions) UnassignRoles(permission PermissionInterface) error {
+	var err error
+	var permissionID int64
+
+	permissionID, err = p.GetPermissionID(permission)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.rbac.db.Exec("DELETE FROM role_permissions WHERE permission_id=?", permissionID)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.rbac.db.Exec("DELETE FROM role_resource_permissions WHERE permission_id=?", permissionID)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.rbac.db.Exec("DELETE FROM user_resource_permissions WHERE permission_id=?", permissionID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (p Permissions) Add(title string, description string, parentID int64) (int64, error) {
-	return p.entity.add(title, description, parentID)
+	return p.rbac.auditedNode(KindPermission, ActionAdd, 0, func(tx *Rbac) (int64, error) {
+		return tx.permissions.entity.add(title, description, parentID)
+	})
 }
 
 func (p Permissions) TitleID(title string) (int64, error) {
@@ -44,15 +186,25 @@ func (p Permissions) getTable() string {
 }
 
 func (p Permissions) ResetAssignments(ensure bool) error {
-	return p.entity.resetAssignments(ensure)
+	if err := p.entity.resetAssignments(ensure); err != nil {
+		return err
+	}
+
+	return p.rbac.record(KindGrant, ActionReset, auditRecord{})
 }
 
 func (p Permissions) Reset(ensure bool) error {
-	return p.entity.reset(ensure)
+	if err := p.entity.reset(ensure); err != nil {
+		return err
+	}
+
+	return p.rbac.record(KindPermission, ActionReset, auditRecord{})
 }
 
 func (p Permissions) AddPath(path string, description []string) (int64, error) {
-	return p.entity.addPath(path, description)
+	return p.rbac.auditedNode(KindPermission, ActionAdd, 0, func(tx *Rbac) (int64, error) {
+		return tx.permissions.entity.addPath(path, description)
+	})
 }
 
 func (p Permissions) GetPermissionID(permission PermissionInterface) (int64, error) {
@@ -61,7 +213,7 @@ func (p Permissions) GetPermissionID(permission PermissionInterface) (int64, err
 	if _, ok := permission.(int64); ok {
 		permissionID = permission.(int64)
 	} else if _, ok := permission.(string); ok {
-		if permission.(string)[:1] == "/ " {
+		if permission.(string)[:1] == "/" {
 			permissionID, err = p.entity.pathID(permission.(string))
 			if err != nil {
 				return 0, err
@@ -98,7 +250,10 @@ func (p Permissions) Depth(id int64) (int64, error) {
 }
 
 func (p Permissions) Edit(id int64, title, description string) error {
-	return p.entity.edit(id, title, description)
+	_, err := p.rbac.auditedNode(KindPermission, ActionEdit, id, func(tx *Rbac) (int64, error) {
+		return id, tx.permissions.entity.edit(id, title, description)
+	})
+	return err
 }
 
 func (p Permissions) ParentNode(id int64) (int64, error) {
@@ -109,10 +264,39 @@ func (p Permissions) ReturnID(entity string) (int64, error) {
 	return p.entity.pathID(entity)
 }
 
-func (p Permissions) Descendants(absolute bool, id int64) ([]path, error) {
+func (p Permissions) Descendants(absolute bool, id int64) ([]Node, error) {
 	return p.entity.descendants(absolute, id)
 }
 
-func (p Permissions) Children(id int64) ([]path, error) {
+func (p Permissions) Children(id int64) ([]Node, error) {
 	return p.entity.children(id)
 }
+
+// Ancestors returns the ancestors of an Entity, starting at the root.
+func (p Permissions) Ancestors(id int64) ([]Node, error) {
+	result, err := p.entity.pathConditional(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return result[:len(result)-1], nil
+}
+
+// Siblings returns the other children of an Entity's parent.
+func (p Permissions) Siblings(id int64) ([]Node, error) {
+	return p.entity.siblings(id)
+}
+
+// Leaves returns the nodes without children in the subtree of an Entity.
+func (p Permissions) Leaves(id int64) ([]Node, error) {
+	return p.entity.leaves(id)
+}
+
+// SubtreeSize returns the number of nodes in the subtree of an Entity,
+// including the Entity itself.
+func (p Permissions) SubtreeSize(id int64) (int64, error) {
+	return p.entity.subtreeSize(id)
+}
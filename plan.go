@@ -0,0 +1,624 @@
+package gorbac
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChangeAction is the kind of modification a Change makes.
+type ChangeAction string
+
+// Plan change actions
+const (
+	ActionAdd      ChangeAction = "add"
+	ActionRemove   ChangeAction = "remove"
+	ActionMove     ChangeAction = "move"
+	ActionRename   ChangeAction = "rename"
+	ActionEdit     ChangeAction = "edit"
+	ActionAssign   ChangeAction = "assign"
+	ActionUnassign ChangeAction = "unassign"
+)
+
+// ChangeKind is the kind of object a Change applies to.
+type ChangeKind string
+
+// Plan change kinds
+const (
+	KindRole        ChangeKind = "role"
+	KindPermission  ChangeKind = "permission"
+	KindGrant       ChangeKind = "grant"
+	KindOwner       ChangeKind = "owner"
+	KindInheritance ChangeKind = "inheritance"
+	KindResource    ChangeKind = "resource"
+)
+
+// Change is a single step of a Plan.
+type Change struct {
+	Action ChangeAction
+	Kind   ChangeKind
+
+	// ID is the existing role or permission that is removed, moved, renamed or edited.
+	ID          int64
+	Path        string
+	To          string
+	Description string
+
+	Role       string
+	Permission string
+	Deny       bool
+	Condition  Condition
+	ValidFrom  *time.Time
+	ValidUntil *time.Time
+	Extension  string
+	Owner      string
+
+	// Junior is the role Role inherits from in an inheritance change.
+	Junior string
+
+	// ResourceType and ResourceID name the resource of a resource grant,
+	// which goes to Role or, when Role is empty, to the user Owner.
+	ResourceType string
+	ResourceID   string
+}
+
+// Plan is the ordered list of changes that brings the database in line with
+// a policy document. A plan is only valid for the database state it was made from.
+type Plan struct {
+	Changes []Change
+}
+
+// Empty reports whether the database already matches the policy.
+func (p *Plan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+func (p *Plan) String() string {
+	var lines []string
+	for _, change := range p.Changes {
+		lines = append(lines, change.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case KindGrant:
+		var verb = "grant"
+		if c.Deny {
+			verb = "deny"
+		}
+		return fmt.Sprintf("%s %s %s: %s%s", changeSymbol(c.Action), verb, c.Role, c.Permission, c.when())
+	case KindOwner:
+		return fmt.Sprintf("%s owner %s/%s: %s%s", changeSymbol(c.Action), c.Extension, c.Owner, c.Role, c.when())
+	case KindInheritance:
+		return fmt.Sprintf("%s inherit %s: %s", changeSymbol(c.Action), c.Role, c.Junior)
+	case KindResource:
+		var holder = c.Role
+		if holder == "" {
+			holder = "user " + c.Owner
+		}
+		return fmt.Sprintf("%s resource %s: %s on %s %s", changeSymbol(c.Action), holder, c.Permission, c.ResourceType, c.ResourceID)
+	}
+
+	switch c.Action {
+	case ActionMove, ActionRename:
+		return fmt.Sprintf("~ %s %s -> %s (%s)", c.Kind, c.Path, c.To, c.Action)
+	case ActionEdit:
+		return fmt.Sprintf("~ %s %s (description)", c.Kind, c.Path)
+	}
+
+	return fmt.Sprintf("%s %s %s", changeSymbol(c.Action), c.Kind, c.Path)
+}
+
+func (c Change) when() string {
+	var when string
+	if c.Condition != "" {
+		when += fmt.Sprintf(" when %s", c.Condition)
+	}
+	if c.ValidFrom != nil {
+		when += fmt.Sprintf(" from %s", c.ValidFrom.UTC().Format(time.RFC3339))
+	}
+	if c.ValidUntil != nil {
+		when += fmt.Sprintf(" until %s", c.ValidUntil.UTC().Format(time.RFC3339))
+	}
+	return when
+}
+
+func changeSymbol(action ChangeAction) string {
+	switch action {
+	case ActionAdd, ActionAssign:
+		return "+"
+	case ActionRemove, ActionUnassign:
+		return "-"
+	}
+	return "~"
+}
+
+// Plan computes the changes needed to turn the database into the desired policy.
+// Nodes that are missing from the policy are removed, nodes with a From path
+// are moved or renamed, and grants are synchronized. Resource grants, owner
+// assignments and inheritance edges are only synchronized when the policy
+// lists them.
+func (r Rbac) Plan(desired *Policy) (*Plan, error) {
+	if err := desired.Validate(); err != nil {
+		return nil, err
+	}
+
+	live, err := r.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := planTree(KindRole, desired.Roles, live.policy.Roles, live.roleIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions, err := planTree(KindPermission, desired.Permissions, live.policy.Permissions, live.permissionIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan = new(Plan)
+	var assigns []Change
+
+	unassigns, grants, err := planGrants(desired, live.policy, roles, permissions)
+	if err != nil {
+		return nil, err
+	}
+	plan.Changes = append(plan.Changes, unassigns...)
+	assigns = append(assigns, grants...)
+
+	if desired.hasInheritance || desired.Inheritance != nil {
+		unassigns, edges, err := planInheritance(desired, live.policy, roles)
+		if err != nil {
+			return nil, err
+		}
+		plan.Changes = append(plan.Changes, unassigns...)
+		assigns = append(assigns, edges...)
+	}
+
+	if desired.hasOwners || desired.Owners != nil {
+		unassigns, owners, err := planOwners(desired, live.policy, roles)
+		if err != nil {
+			return nil, err
+		}
+		plan.Changes = append(plan.Changes, unassigns...)
+		assigns = append(assigns, owners...)
+	}
+
+	plan.Changes = append(plan.Changes, roles.changes...)
+	plan.Changes = append(plan.Changes, permissions.changes...)
+	plan.Changes = append(plan.Changes, roles.edits...)
+	plan.Changes = append(plan.Changes, permissions.edits...)
+	plan.Changes = append(plan.Changes, assigns...)
+	plan.Changes = append(plan.Changes, roles.removes...)
+	plan.Changes = append(plan.Changes, permissions.removes...)
+
+	return plan, nil
+}
+
+// Apply executes a plan in a single transaction.
+func (r Rbac) Apply(plan *Plan) error {
+	return r.transaction(func(tx *Rbac) error {
+		for _, change := range plan.Changes {
+			if err := tx.applyChange(change); err != nil {
+				return fmt.Errorf("%v: %v", change, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (r Rbac) applyChange(change Change) error {
+	switch change.Kind {
+	case KindGrant:
+		if change.Action == ActionUnassign {
+			return r.Unassign(change.Role, change.Permission)
+		}
+		_, err := r.assign(change.Role, change.Permission, change.Deny, policyOptions(change.Condition, change.ValidFrom, change.ValidUntil))
+		return err
+
+	case KindResource:
+		var resource = PolicyResource{Role: change.Role, User: change.Owner, Permission: change.Permission, ResourceType: change.ResourceType, ResourceID: change.ResourceID}
+		if change.Action == ActionUnassign {
+			return r.unassignResource(resource)
+		}
+		return r.assignResource(resource)
+
+	case KindInheritance:
+		if change.Action == ActionUnassign {
+			return r.roles.RemoveInheritance(change.Role, change.Junior)
+		}
+		return r.roles.AddInheritance(change.Role, change.Junior)
+
+	case KindOwner:
+		var owner = PolicyOwner{Extension: change.Extension, Owner: change.Owner, Condition: change.Condition, ValidFrom: change.ValidFrom, ValidUntil: change.ValidUntil}
+		extension, err := r.ownerExtension(owner.extension())
+		if err != nil {
+			return err
+		}
+		if change.Action == ActionUnassign {
+			return extension.Unassign(change.Role, owner.owner())
+		}
+		_, err = extension.Assign(change.Role, owner.owner(), owner.meta())
+		return err
+	}
+
+	switch change.Action {
+	case ActionRemove:
+		if change.Kind == KindPermission {
+			return r.permissions.Remove(change.ID, false)
+		}
+		return r.roles.Remove(change.ID, false)
+
+	case ActionAdd, ActionMove, ActionRename, ActionEdit:
+	default:
+		return fmt.Errorf("unknown change action: %v", change.Action)
+	}
+
+	_, err := r.auditedNode(change.Kind, change.Action, change.ID, func(tx *Rbac) (int64, error) {
+		var e = tx.tree(change.Kind)
+
+		switch change.Action {
+		case ActionAdd:
+			return e.addPath(change.Path, nodeDescriptions(PolicyNode{Path: change.Path, Description: change.Description}))
+
+		case ActionMove:
+			var parentID = tx.rootID()
+			if parent := parentPath(change.To); parent != "/" {
+				var err error
+				if parentID, err = e.pathID(parent); err != nil {
+					return 0, err
+				}
+			}
+			// The title changes with the move, so only the final title may clash.
+			if err := e.move(change.ID, parentID, baseName(change.To)); err != nil {
+				return 0, err
+			}
+			return change.ID, e.edit(change.ID, baseName(change.To), change.Description)
+
+		case ActionRename:
+			return change.ID, e.edit(change.ID, baseName(change.To), change.Description)
+		}
+
+		return change.ID, e.edit(change.ID, baseName(change.Path), change.Description)
+	})
+	return err
+}
+
+// treePlan holds the planned changes for one tree and maps live paths to the
+// paths they will have once the moves and renames are applied.
+type treePlan struct {
+	fromTo map[string]string
+	paths  map[string]bool
+	titles map[string][]string
+
+	changes []Change
+	edits   []Change
+	removes []Change
+}
+
+func planTree(kind ChangeKind, desired, live []PolicyNode, ids map[string]int64) (*treePlan, error) {
+	var t = &treePlan{
+		fromTo: make(map[string]string),
+		paths:  make(map[string]bool),
+		titles: make(map[string][]string),
+	}
+
+	var explicit = make(map[string]PolicyNode, len(desired))
+	for _, node := range desired {
+		explicit[node.Path] = node
+		if node.From != "" {
+			if _, ok := ids[node.From]; !ok {
+				return nil, node.pos.errorf("%s %q does not exist", kind, node.From)
+			}
+			t.fromTo[node.From] = node.Path
+		}
+
+		// Ancestors that are not listed are still part of the desired tree.
+		for path := node.Path; path != "/"; path = parentPath(path) {
+			if !t.paths[path] {
+				t.paths[path] = true
+				t.titles[baseName(path)] = append(t.titles[baseName(path)], path)
+			}
+		}
+	}
+
+	var projected = make(map[string]string, len(live))
+	for _, node := range live {
+		var id = ids[node.Path]
+		var to = t.project(node.Path)
+
+		if other, ok := projected[to]; ok {
+			return nil, fmt.Errorf("%s %q and %q would both end up at %q", kind, other, node.Path, to)
+		}
+		projected[to] = node.Path
+
+		if _, ok := t.fromTo[node.Path]; ok {
+			var action = ActionMove
+			if t.project(parentPath(node.Path)) == parentPath(to) {
+				action = ActionRename
+			}
+			t.changes = append(t.changes, Change{Action: action, Kind: kind, ID: id, Path: node.Path, To: to, Description: explicit[to].Description})
+			continue
+		}
+
+		if !t.paths[to] {
+			t.removes = append(t.removes, Change{Action: ActionRemove, Kind: kind, ID: id, Path: node.Path})
+			continue
+		}
+
+		if want, ok := explicit[to]; ok && want.Description != node.Description {
+			t.edits = append(t.edits, Change{Action: ActionEdit, Kind: kind, ID: id, Path: to, Description: want.Description})
+		}
+	}
+
+	for path := range t.paths {
+		if _, ok := projected[path]; !ok {
+			t.changes = append(t.changes, Change{Action: ActionAdd, Kind: kind, Path: path, Description: explicit[path].Description})
+		}
+	}
+
+	// Parents are created or moved before their children, and removed after them.
+	sort.Slice(t.changes, func(i, j int) bool {
+		a, b := t.changes[i].target(), t.changes[j].target()
+		if depthOf(a) != depthOf(b) {
+			return depthOf(a) < depthOf(b)
+		}
+		// Moves go first, so an added node can take over a path that was moved away.
+		if (t.changes[i].Action == ActionAdd) != (t.changes[j].Action == ActionAdd) {
+			return t.changes[j].Action == ActionAdd
+		}
+		return a < b
+	})
+	sort.Slice(t.removes, func(i, j int) bool {
+		a, b := t.removes[i].Path, t.removes[j].Path
+		if depthOf(a) != depthOf(b) {
+			return depthOf(a) > depthOf(b)
+		}
+		return a < b
+	})
+
+	return t, nil
+}
+
+// project returns the path a live node will have after the planned moves.
+func (t *treePlan) project(path string) string {
+	for prefix := path; prefix != "/"; prefix = parentPath(prefix) {
+		if to, ok := t.fromTo[prefix]; ok {
+			return to + path[len(prefix):]
+		}
+	}
+	return path
+}
+
+// resolve turns a title or path reference from the policy into a desired path.
+func (t *treePlan) resolve(ref string) (string, bool) {
+	if ref == "/" || t.paths[ref] {
+		return ref, true
+	}
+	if ref[:1] != "/" && len(t.titles[ref]) == 1 {
+		return t.titles[ref][0], true
+	}
+	return "", false
+}
+
+func planGrants(desired, live *Policy, roles, permissions *treePlan) ([]Change, []Change, error) {
+	var want = make(map[string]Change)
+	for _, grant := range desired.Grants {
+		role, ok := roles.resolve(grant.Role)
+		if !ok {
+			return nil, nil, grant.pos.errorf("unknown or ambiguous role %q", grant.Role)
+		}
+		var permission = grant.Permission
+		if !isPattern(permission) {
+			permission, ok = permissions.resolve(grant.Permission)
+			if !ok {
+				return nil, nil, grant.pos.errorf("unknown or ambiguous permission %q", grant.Permission)
+			}
+		}
+		want[grantKey(role, permission, grant)] = Change{Action: ActionAssign, Kind: KindGrant, Role: role, Permission: permission, Deny: grant.Deny, Condition: grant.Condition, ValidFrom: grant.ValidFrom, ValidUntil: grant.ValidUntil}
+	}
+
+	var have = make(map[string]bool)
+	var unassigns []Change
+	for _, grant := range live.Grants {
+		var permission = grant.Permission
+		if !isPattern(permission) {
+			permission = permissions.project(permission)
+		}
+		var key = grantKey(roles.project(grant.Role), permission, grant)
+		have[key] = true
+		if _, ok := want[key]; !ok {
+			unassigns = append(unassigns, Change{Action: ActionUnassign, Kind: KindGrant, Role: grant.Role, Permission: grant.Permission, Deny: grant.Deny, Condition: grant.Condition, ValidFrom: grant.ValidFrom, ValidUntil: grant.ValidUntil})
+		}
+	}
+
+	var assigns []Change
+	for key, change := range want {
+		if !have[key] {
+			assigns = append(assigns, change)
+		}
+	}
+	sort.Slice(assigns, func(i, j int) bool {
+		if assigns[i].Role != assigns[j].Role {
+			return assigns[i].Role < assigns[j].Role
+		}
+		return assigns[i].Permission < assigns[j].Permission
+	})
+
+	if desired.hasResources || desired.Resources != nil {
+		resourceUnassigns, resourceAssigns, err := planResources(desired, live, roles, permissions)
+		if err != nil {
+			return nil, nil, err
+		}
+		unassigns = append(unassigns, resourceUnassigns...)
+		assigns = append(assigns, resourceAssigns...)
+	}
+
+	return unassigns, assigns, nil
+}
+
+func planResources(desired, live *Policy, roles, permissions *treePlan) ([]Change, []Change, error) {
+	var want = make(map[string]Change)
+	for _, resource := range desired.Resources {
+		var role string
+		if resource.Role != "" {
+			var ok bool
+			if role, ok = roles.resolve(resource.Role); !ok {
+				return nil, nil, resource.pos.errorf("unknown or ambiguous role %q", resource.Role)
+			}
+		}
+		permission, ok := permissions.resolve(resource.Permission)
+		if !ok {
+			return nil, nil, resource.pos.errorf("unknown or ambiguous permission %q", resource.Permission)
+		}
+		want[resourceKey(role, permission, resource)] = Change{Action: ActionAssign, Kind: KindResource, Role: role, Owner: resource.User, Permission: permission, ResourceType: resource.ResourceType, ResourceID: resource.ResourceID}
+	}
+
+	var have = make(map[string]bool)
+	var unassigns []Change
+	for _, resource := range live.Resources {
+		var role string
+		if resource.Role != "" {
+			role = roles.project(resource.Role)
+		}
+		var key = resourceKey(role, permissions.project(resource.Permission), resource)
+		have[key] = true
+		if _, ok := want[key]; !ok {
+			unassigns = append(unassigns, Change{Action: ActionUnassign, Kind: KindResource, Role: resource.Role, Owner: resource.User, Permission: resource.Permission, ResourceType: resource.ResourceType, ResourceID: resource.ResourceID})
+		}
+	}
+
+	var keys []string
+	for key := range want {
+		if !have[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var assigns []Change
+	for _, key := range keys {
+		assigns = append(assigns, want[key])
+	}
+
+	return unassigns, assigns, nil
+}
+
+func resourceKey(role, permission string, resource PolicyResource) string {
+	return strings.Join([]string{role, resource.User, permission, resource.ResourceType, resource.ResourceID}, "\x00")
+}
+
+func grantKey(role, permission string, grant PolicyGrant) string {
+	return fmt.Sprintf("%s\x00%s\x00%t\x00%s\x00%s", role, permission, grant.Deny, grant.Condition, validityKey(grant.ValidFrom, grant.ValidUntil))
+}
+
+func ownerKey(role string, owner PolicyOwner) string {
+	return strings.Join([]string{owner.extension(), owner.Owner, role, string(owner.Condition), validityKey(owner.ValidFrom, owner.ValidUntil)}, "\x00")
+}
+
+func planOwners(desired, live *Policy, roles *treePlan) ([]Change, []Change, error) {
+	var want = make(map[string]Change)
+	for _, owner := range desired.Owners {
+		role, ok := roles.resolve(owner.Role)
+		if !ok {
+			return nil, nil, owner.pos.errorf("unknown or ambiguous role %q", owner.Role)
+		}
+		want[ownerKey(role, owner)] = Change{Action: ActionAssign, Kind: KindOwner, Extension: owner.extension(), Owner: owner.Owner, Role: role, Condition: owner.Condition, ValidFrom: owner.ValidFrom, ValidUntil: owner.ValidUntil}
+	}
+
+	var have = make(map[string]bool)
+	var unassigns []Change
+	for _, owner := range live.Owners {
+		var key = ownerKey(roles.project(owner.Role), owner)
+		have[key] = true
+		if _, ok := want[key]; !ok {
+			unassigns = append(unassigns, Change{Action: ActionUnassign, Kind: KindOwner, Extension: owner.extension(), Owner: owner.Owner, Role: owner.Role, Condition: owner.Condition, ValidFrom: owner.ValidFrom, ValidUntil: owner.ValidUntil})
+		}
+	}
+
+	var assigns []Change
+	for key, change := range want {
+		if !have[key] {
+			assigns = append(assigns, change)
+		}
+	}
+	sort.Slice(assigns, func(i, j int) bool {
+		if assigns[i].Extension != assigns[j].Extension {
+			return assigns[i].Extension < assigns[j].Extension
+		}
+		if assigns[i].Owner != assigns[j].Owner {
+			return lessOwner(assigns[i].Owner, assigns[j].Owner)
+		}
+		return assigns[i].Role < assigns[j].Role
+	})
+
+	return unassigns, assigns, nil
+}
+
+func planInheritance(desired, live *Policy, roles *treePlan) ([]Change, []Change, error) {
+	var want = make(map[string]Change)
+	for _, edge := range desired.Inheritance {
+		senior, ok := roles.resolve(edge.Senior)
+		if !ok {
+			return nil, nil, edge.pos.errorf("unknown or ambiguous role %q", edge.Senior)
+		}
+		junior, ok := roles.resolve(edge.Junior)
+		if !ok {
+			return nil, nil, edge.pos.errorf("unknown or ambiguous role %q", edge.Junior)
+		}
+		want[senior+"\x00"+junior] = Change{Action: ActionAssign, Kind: KindInheritance, Role: senior, Junior: junior}
+	}
+
+	var have = make(map[string]bool)
+	var unassigns []Change
+	for _, edge := range live.Inheritance {
+		var key = roles.project(edge.Senior) + "\x00" + roles.project(edge.Junior)
+		have[key] = true
+		if _, ok := want[key]; !ok {
+			unassigns = append(unassigns, Change{Action: ActionUnassign, Kind: KindInheritance, Role: edge.Senior, Junior: edge.Junior})
+		}
+	}
+
+	var assigns []Change
+	for key, change := range want {
+		if !have[key] {
+			assigns = append(assigns, change)
+		}
+	}
+	sort.Slice(assigns, func(i, j int) bool {
+		if assigns[i].Role != assigns[j].Role {
+			return assigns[i].Role < assigns[j].Role
+		}
+		return assigns[i].Junior < assigns[j].Junior
+	})
+
+	return unassigns, assigns, nil
+}
+
+func (c Change) target() string {
+	if c.To != "" {
+		return c.To
+	}
+	return c.Path
+}
+
+func parentPath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+func baseName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+func depthOf(path string) int {
+	return strings.Count(path, "/")
+}
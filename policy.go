@@ -0,0 +1,503 @@
+package gorbac
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy describes a role tree, a permission tree and the grants between them.
+// It can be written as YAML or JSON.
+type Policy struct {
+	Roles       []PolicyNode        `json:"roles" yaml:"roles"`
+	Permissions []PolicyNode        `json:"permissions" yaml:"permissions"`
+	Grants      []PolicyGrant       `json:"grants" yaml:"grants"`
+	Resources   []PolicyResource    `json:"resources,omitempty" yaml:"resources,omitempty"`
+	Inheritance []PolicyInheritance `json:"inheritance,omitempty" yaml:"inheritance,omitempty"`
+	Owners      []PolicyOwner       `json:"owners,omitempty" yaml:"owners,omitempty"`
+
+	// hasOwners, hasInheritance and hasResources record an explicit key, so
+	// that Plan only manages owner assignments, inheritance edges and
+	// resource grants when the document asks for it.
+	hasOwners      bool
+	hasInheritance bool
+	hasResources   bool
+}
+
+// PolicyNode is a single role or permission, identified by its full path.
+// From names the path the node had before, which Plan turns into a move or rename.
+type PolicyNode struct {
+	Path        string `json:"path" yaml:"path"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	From        string `json:"from,omitempty" yaml:"from,omitempty"`
+
+	pos position
+}
+
+// PolicyGrant assigns a permission to a role. Both can be a title or a path,
+// and the permission can also be a pattern such as /projects/*/read.
+// Deny withholds the permission instead; see Rbac.Deny.
+type PolicyGrant struct {
+	Role       string     `json:"role" yaml:"role"`
+	Permission string     `json:"permission" yaml:"permission"`
+	Deny       bool       `json:"deny,omitempty" yaml:"deny,omitempty"`
+	Condition  Condition  `json:"condition,omitempty" yaml:"condition,omitempty"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty" yaml:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty" yaml:"valid_until,omitempty"`
+
+	pos position
+}
+
+// PolicyResource grants a permission on a single resource to either a role or
+// a user; see Rbac.AssignResource and Rbac.AssignUserResource.
+type PolicyResource struct {
+	Role         string `json:"role,omitempty" yaml:"role,omitempty"`
+	User         string `json:"user,omitempty" yaml:"user,omitempty"`
+	Permission   string `json:"permission" yaml:"permission"`
+	ResourceType string `json:"resource_type" yaml:"resource_type"`
+	ResourceID   string `json:"resource_id" yaml:"resource_id"`
+
+	pos position
+}
+
+// PolicyInheritance lets Senior inherit everything Junior has; see
+// Roles.AddInheritance. Both can be a title or a path.
+type PolicyInheritance struct {
+	Senior string `json:"senior" yaml:"senior"`
+	Junior string `json:"junior" yaml:"junior"`
+
+	pos position
+}
+
+// PolicyOwner assigns a role to an owner of a registered owner extension.
+// Extension defaults to "users" when empty.
+type PolicyOwner struct {
+	Extension  string     `json:"extension,omitempty" yaml:"extension,omitempty"`
+	Owner      string     `json:"owner" yaml:"owner"`
+	Role       string     `json:"role" yaml:"role"`
+	Condition  Condition  `json:"condition,omitempty" yaml:"condition,omitempty"`
+	ValidFrom  *time.Time `json:"valid_from,omitempty" yaml:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty" yaml:"valid_until,omitempty"`
+
+	pos position
+}
+
+type position struct {
+	line   int
+	column int
+}
+
+// PolicyError reports an invalid entry in a policy document.
+type PolicyError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+func (p position) errorf(format string, args ...interface{}) error {
+	return &PolicyError{Line: p.line, Column: p.column, Msg: fmt.Sprintf(format, args...)}
+}
+
+// ParsePolicy reads a YAML or JSON policy document and validates it.
+func ParsePolicy(reader io.Reader) (*Policy, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is a subset of YAML, so a single parser keeps line and column
+	// information for both formats.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	var policy = new(Policy)
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		return policy, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, &PolicyError{Line: root.Line, Column: root.Column, Msg: "policy must be a mapping"}
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		var err error
+		switch key.Value {
+		case "roles":
+			policy.Roles, err = decodeNodes(value)
+		case "permissions":
+			policy.Permissions, err = decodeNodes(value)
+		case "grants":
+			err = decodeSequence(value, []string{"role", "permission", "deny", "condition", "valid_from", "valid_until"}, func(item *yaml.Node) error {
+				var grant PolicyGrant
+				if err := item.Decode(&grant); err != nil {
+					return err
+				}
+				grant.pos = position{item.Line, item.Column}
+				policy.Grants = append(policy.Grants, grant)
+				return nil
+			})
+		case "resources":
+			policy.hasResources = true
+			err = decodeSequence(value, []string{"role", "user", "permission", "resource_type", "resource_id"}, func(item *yaml.Node) error {
+				var resource PolicyResource
+				if err := item.Decode(&resource); err != nil {
+					return err
+				}
+				resource.pos = position{item.Line, item.Column}
+				policy.Resources = append(policy.Resources, resource)
+				return nil
+			})
+		case "inheritance":
+			policy.hasInheritance = true
+			err = decodeSequence(value, []string{"senior", "junior"}, func(item *yaml.Node) error {
+				var edge PolicyInheritance
+				if err := item.Decode(&edge); err != nil {
+					return err
+				}
+				edge.pos = position{item.Line, item.Column}
+				policy.Inheritance = append(policy.Inheritance, edge)
+				return nil
+			})
+		case "owners":
+			policy.hasOwners = true
+			err = decodeSequence(value, []string{"extension", "owner", "role", "condition", "valid_from", "valid_until"}, func(item *yaml.Node) error {
+				var owner PolicyOwner
+				if err := item.Decode(&owner); err != nil {
+					return err
+				}
+				owner.pos = position{item.Line, item.Column}
+				policy.Owners = append(policy.Owners, owner)
+				return nil
+			})
+		default:
+			err = &PolicyError{Line: key.Line, Column: key.Column, Msg: fmt.Sprintf("unknown key %q", key.Value)}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+func decodeNodes(value *yaml.Node) ([]PolicyNode, error) {
+	var nodes []PolicyNode
+	err := decodeSequence(value, []string{"path", "description", "from"}, func(item *yaml.Node) error {
+		var node PolicyNode
+		if err := item.Decode(&node); err != nil {
+			return err
+		}
+		node.pos = position{item.Line, item.Column}
+		nodes = append(nodes, node)
+		return nil
+	})
+
+	return nodes, err
+}
+
+func decodeSequence(value *yaml.Node, keys []string, decode func(item *yaml.Node) error) error {
+	if value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+		return nil
+	}
+	if value.Kind != yaml.SequenceNode {
+		return &PolicyError{Line: value.Line, Column: value.Column, Msg: "expected a list"}
+	}
+
+	for _, item := range value.Content {
+		if item.Kind != yaml.MappingNode {
+			return &PolicyError{Line: item.Line, Column: item.Column, Msg: "expected a mapping"}
+		}
+		if err := checkKeys(item, keys); err != nil {
+			return err
+		}
+		if err := decode(item); err != nil {
+			if _, ok := err.(*PolicyError); ok {
+				return err
+			}
+			return &PolicyError{Line: item.Line, Column: item.Column, Msg: err.Error()}
+		}
+	}
+
+	return nil
+}
+
+func checkKeys(item *yaml.Node, keys []string) error {
+	for i := 0; i < len(item.Content); i += 2 {
+		var known bool
+		for _, key := range keys {
+			if item.Content[i].Value == key {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return &PolicyError{Line: item.Content[i].Line, Column: item.Content[i].Column, Msg: fmt.Sprintf("unknown key %q", item.Content[i].Value)}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the document for malformed paths, duplicates and empty references.
+func (p *Policy) Validate() error {
+	for _, nodes := range [][]PolicyNode{p.Roles, p.Permissions} {
+		var seen = make(map[string]bool, len(nodes))
+		var seenFrom = make(map[string]bool)
+		for _, node := range nodes {
+			if !validPolicyPath(node.Path) {
+				return node.pos.errorf("invalid path %q", node.Path)
+			}
+			if seen[node.Path] {
+				return node.pos.errorf("duplicate path %q", node.Path)
+			}
+			seen[node.Path] = true
+
+			if node.From == "" {
+				continue
+			}
+			if !validPolicyPath(node.From) {
+				return node.pos.errorf("invalid path %q", node.From)
+			}
+			if seenFrom[node.From] {
+				return node.pos.errorf("duplicate from path %q", node.From)
+			}
+			seenFrom[node.From] = true
+		}
+	}
+
+	for _, grant := range p.Grants {
+		if grant.Role == "" {
+			return grant.pos.errorf("grant requires a role")
+		}
+		if grant.Permission == "" {
+			return grant.pos.errorf("grant requires a permission")
+		}
+		if isPattern(grant.Permission) && !validPattern(grant.Permission) {
+			return grant.pos.errorf("invalid permission pattern %q", grant.Permission)
+		}
+		if isPattern(grant.Permission) && grant.Deny {
+			return grant.pos.errorf("%v", ErrDenyPattern)
+		}
+		if err := grant.options().validate(); err != nil {
+			return grant.pos.errorf("%v", err)
+		}
+	}
+
+	for _, resource := range p.Resources {
+		if (resource.Role == "") == (resource.User == "") {
+			return resource.pos.errorf("resource grant requires either a role or a user")
+		}
+		if resource.Permission == "" {
+			return resource.pos.errorf("resource grant requires a permission")
+		}
+		if isPattern(resource.Permission) {
+			return resource.pos.errorf("resource grant permission %q cannot be a pattern", resource.Permission)
+		}
+		if resource.ResourceType == "" || resource.ResourceID == "" {
+			return resource.pos.errorf("%v", ErrResourceRequired)
+		}
+	}
+
+	for _, edge := range p.Inheritance {
+		if edge.Senior == "" || edge.Junior == "" {
+			return edge.pos.errorf("inheritance requires a senior and a junior role")
+		}
+	}
+
+	for _, owner := range p.Owners {
+		if owner.Owner == "" {
+			return owner.pos.errorf("owner assignment requires an owner")
+		}
+		if owner.Role == "" {
+			return owner.pos.errorf("owner assignment requires a role")
+		}
+		if err := owner.options().validate(); err != nil {
+			return owner.pos.errorf("%v", err)
+		}
+	}
+
+	return nil
+}
+
+func validPolicyPath(path string) bool {
+	if len(path) < 2 || path[:1] != "/" || path[len(path)-1:] == "/" {
+		return false
+	}
+
+	for _, part := range strings.Split(path[1:], "/") {
+		if part == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Import reads a YAML or JSON policy document and creates the roles,
+// permissions and assignments it describes. The import runs in a single
+// transaction, so a failing entry leaves the database untouched.
+func (r Rbac) Import(reader io.Reader) error {
+	policy, err := ParsePolicy(reader)
+	if err != nil {
+		return err
+	}
+
+	return r.transaction(func(tx *Rbac) error {
+		return tx.importPolicy(policy)
+	})
+}
+
+func (r Rbac) importPolicy(policy *Policy) error {
+	for _, node := range policy.Roles {
+		if _, err := r.roles.AddPath(node.Path, nodeDescriptions(node)); err != nil {
+			return node.pos.errorf("%v", err)
+		}
+	}
+
+	for _, node := range policy.Permissions {
+		if _, err := r.permissions.AddPath(node.Path, nodeDescriptions(node)); err != nil {
+			return node.pos.errorf("%v", err)
+		}
+	}
+
+	for _, grant := range policy.Grants {
+		if _, err := r.assign(grant.Role, grant.Permission, grant.Deny, grant.options()); err != nil {
+			return grant.pos.errorf("%v", err)
+		}
+	}
+
+	for _, resource := range policy.Resources {
+		if err := r.assignResource(resource); err != nil {
+			return resource.pos.errorf("%v", err)
+		}
+	}
+
+	for _, edge := range policy.Inheritance {
+		if err := r.roles.AddInheritance(edge.Senior, edge.Junior); err != nil {
+			return edge.pos.errorf("%v", err)
+		}
+	}
+
+	for _, owner := range policy.Owners {
+		extension, err := r.ownerExtension(owner.extension())
+		if err != nil {
+			return owner.pos.errorf("%v", err)
+		}
+
+		if _, err := extension.Assign(owner.Role, owner.owner(), owner.meta()); err != nil {
+			return owner.pos.errorf("%v", err)
+		}
+	}
+
+	return nil
+}
+
+// nodeDescriptions places the node description at the last path segment,
+// which is the one AddPath creates for it.
+func nodeDescriptions(node PolicyNode) []string {
+	var descriptions = make([]string, strings.Count(node.Path, "/"))
+	descriptions[len(descriptions)-1] = node.Description
+	return descriptions
+}
+
+func (o PolicyOwner) extension() string {
+	if o.Extension == "" {
+		return "users"
+	}
+	return o.Extension
+}
+
+// owner returns numeric owners as int64 so they pass the same checks as
+// owners supplied directly to Owners.Assign.
+func (o PolicyOwner) owner() Owner {
+	if id, err := strconv.ParseInt(o.Owner, 10, 64); err == nil {
+		return id
+	}
+	return o.Owner
+}
+
+// assignResource makes the role or user grant a PolicyResource describes.
+func (r Rbac) assignResource(resource PolicyResource) error {
+	var err error
+	if resource.Role != "" {
+		_, err = r.AssignResource(resource.Role, resource.Permission, resource.ResourceType, resource.ResourceID)
+	} else {
+		_, err = r.AssignUserResource(resource.user(), resource.Permission, resource.ResourceType, resource.ResourceID)
+	}
+	return err
+}
+
+func (r Rbac) unassignResource(resource PolicyResource) error {
+	if resource.Role != "" {
+		return r.UnassignResource(resource.Role, resource.Permission, resource.ResourceType, resource.ResourceID)
+	}
+	return r.UnassignUserResource(resource.user(), resource.Permission, resource.ResourceType, resource.ResourceID)
+}
+
+// user returns numeric users as int64, like PolicyOwner.owner.
+func (p PolicyResource) user() UserInterface {
+	if id, err := strconv.ParseInt(p.User, 10, 64); err == nil {
+		return id
+	}
+	return p.User
+}
+
+func (g PolicyGrant) options() AssignmentOptions {
+	return policyOptions(g.Condition, g.ValidFrom, g.ValidUntil)
+}
+
+func (o PolicyOwner) options() AssignmentOptions {
+	return policyOptions(o.Condition, o.ValidFrom, o.ValidUntil)
+}
+
+// meta is passed on to Owners.Assign. Owners without a validity window get
+// a bare Condition, which extensions that predate validity windows understand.
+func (o PolicyOwner) meta() interface{} {
+	if o.ValidFrom != nil || o.ValidUntil != nil {
+		return o.options()
+	}
+	if o.Condition == "" {
+		return nil
+	}
+	return o.Condition
+}
+
+func policyOptions(condition Condition, from, until *time.Time) AssignmentOptions {
+	var options = AssignmentOptions{Condition: condition}
+	if from != nil {
+		options.ValidFrom = *from
+	}
+	if until != nil {
+		options.ValidUntil = *until
+	}
+	return options
+}
+
+// validityKey identifies a validity window in plan keys and output.
+func validityKey(from, until *time.Time) string {
+	var parts = []string{"", ""}
+	if from != nil {
+		parts[0] = from.UTC().Format(time.RFC3339)
+	}
+	if until != nil {
+		parts[1] = until.UTC().Format(time.RFC3339)
+	}
+	return strings.Join(parts, "\x00")
+}
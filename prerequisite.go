@@ -0,0 +1,272 @@
+package gorbac
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidPrerequisite = errors.New("a role cannot be its own prerequisite")
+	ErrPrerequisiteCycle   = errors.New("prerequisite would create a cycle")
+	ErrMissingPrerequisite = errors.New("missing prerequisite role")
+	ErrPrerequisiteInUse   = errors.New("prerequisite role is still needed")
+)
+
+// RevocationPolicy controls what Users.Unassign does when it revokes a role
+// that another role of the same user requires.
+type RevocationPolicy int
+
+// BlockRevocation refuses the revocation with ErrPrerequisiteInUse.
+// CascadeRevocation also revokes every role that loses a prerequisite.
+const (
+	BlockRevocation RevocationPolicy = iota
+	CascadeRevocation
+)
+
+// PrerequisiteError reports a role whose prerequisite a user does not hold.
+// Err is ErrMissingPrerequisite for an assignment and ErrPrerequisiteInUse
+// for a blocked revocation.
+type PrerequisiteError struct {
+	Owner        Owner
+	Role         string
+	Prerequisite string
+	Err          error
+}
+
+func (e *PrerequisiteError) Error() string {
+	if e.Err == ErrPrerequisiteInUse {
+		return fmt.Sprintf("%v: user %v holds %s, which requires %s", e.Err, e.Owner, e.Role, e.Prerequisite)
+	}
+	return fmt.Sprintf("%v: user %v needs %s before %s", e.Err, e.Owner, e.Prerequisite, e.Role)
+}
+
+func (e *PrerequisiteError) Unwrap() error {
+	return e.Err
+}
+
+// AddPrerequisite makes holding prerequisite, directly or through
+// inheritance, a requirement for being assigned role. Existing assignments
+// are not checked.
+func (r Roles) AddPrerequisite(role RoleInterface, prerequisite RoleInterface) error {
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return err
+	}
+
+	prerequisiteID, err := r.GetRoleID(prerequisite)
+	if err != nil {
+		return err
+	}
+
+	if roleID == prerequisiteID {
+		return ErrInvalidPrerequisite
+	}
+
+	return r.rbac.auditedEdge(KindPrerequisite, ActionAssign, roleID, prerequisiteID, func(tx *Rbac) (bool, error) {
+		var seen = map[int64]bool{prerequisiteID: true}
+		var frontier = []int64{prerequisiteID}
+		for len(frontier) > 0 {
+			required, err := tx.roles.prerequisiteIDs(frontier)
+			if err != nil {
+				return false, err
+			}
+
+			frontier = nil
+			for _, id := range required {
+				if id == roleID {
+					return false, ErrPrerequisiteCycle
+				}
+				if !seen[id] {
+					seen[id] = true
+					frontier = append(frontier, id)
+				}
+			}
+		}
+
+		_, err := tx.db.Exec("INSERT INTO role_prerequisites (role_id, prerequisite_id) VALUES(?,?)", roleID, prerequisiteID)
+		return true, err
+	})
+}
+
+// RemovePrerequisite deletes a requirement added by AddPrerequisite.
+func (r Roles) RemovePrerequisite(role RoleInterface, prerequisite RoleInterface) error {
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return err
+	}
+
+	prerequisiteID, err := r.GetRoleID(prerequisite)
+	if err != nil {
+		return err
+	}
+
+	return r.rbac.auditedEdge(KindPrerequisite, ActionUnassign, roleID, prerequisiteID, func(tx *Rbac) (bool, error) {
+		return tx.deleteRows("DELETE FROM role_prerequisites WHERE role_id=? AND prerequisite_id=?", roleID, prerequisiteID)
+	})
+}
+
+// Prerequisites returns the roles a user must hold before being assigned role.
+func (r Roles) Prerequisites(role RoleInterface) ([]Role, error) {
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.rbac.db.Query(`
+		SELECT TR.ID, TR.Title, TR.Description
+		FROM role_prerequisites AS TP
+		JOIN roles AS TR ON (TR.ID = TP.prerequisite_id)
+		WHERE TP.role_id=? ORDER BY TR.ID`, roleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.Title, &role.Description); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+func (r Roles) prerequisiteIDs(roleIDs []int64) ([]int64, error) {
+	query := fmt.Sprintf("SELECT prerequisite_id FROM role_prerequisites WHERE role_id IN (%s)", placeholders(len(roleIDs)))
+	rows, err := r.rbac.db.Query(query, int64Args(roleIDs)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func (r Roles) removePrerequisites(roleID int64) error {
+	_, err := r.rbac.db.Exec("DELETE FROM role_prerequisites WHERE role_id=? OR prerequisite_id=?", roleID, roleID)
+	return err
+}
+
+// checkPrerequisites fails with a *PrerequisiteError when userID lacks a
+// prerequisite of roleID.
+func (u Users) checkPrerequisites(roleID int64, userID Owner) error {
+	required, err := u.rbac.roles.prerequisiteIDs([]int64{roleID})
+	if err != nil {
+		return err
+	}
+
+	for _, prerequisiteID := range required {
+		held, err := u.hasRole(prerequisiteID, userID)
+		if err != nil {
+			return err
+		}
+		if !held {
+			return u.prerequisiteError(userID, roleID, prerequisiteID, ErrMissingPrerequisite)
+		}
+	}
+
+	return nil
+}
+
+// revokeDependents handles the roles of userID that lost a prerequisite
+// when roleID was revoked, following the configured RevocationPolicy. Only
+// roles requiring a role that roleID covered can be affected. Cascades
+// continue with the dependents of every role they revoke.
+func (u Users) revokeDependents(userID Owner, roleID int64) error {
+	var revoked = map[int64]bool{roleID: true}
+	var pending = []int64{roleID}
+	for len(pending) > 0 {
+		cte, args := u.rbac.roles.coverage(pending[:1])
+		pending = pending[1:]
+
+		rows, err := u.rbac.db.Query(fmt.Sprintf(`%s
+			SELECT DISTINCT TP.role_id, TP.prerequisite_id
+			FROM role_prerequisites AS TP
+			JOIN covered ON (covered.id = TP.prerequisite_id)
+			JOIN %s AS TRel ON (TRel.role_id = TP.role_id)
+			WHERE TRel.user_id=?`, cte, u.getTable()), append(args, userID)...)
+		if err != nil {
+			return err
+		}
+
+		var pairs [][2]int64
+		for rows.Next() {
+			var pair [2]int64
+			if err := rows.Scan(&pair[0], &pair[1]); err != nil {
+				rows.Close()
+				return err
+			}
+			pairs = append(pairs, pair)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, pair := range pairs {
+			if revoked[pair[0]] {
+				continue
+			}
+
+			held, err := u.hasRole(pair[1], userID)
+			if err != nil {
+				return err
+			}
+			if held {
+				continue
+			}
+
+			if u.rbac.revocation != CascadeRevocation {
+				return u.prerequisiteError(userID, pair[0], pair[1], ErrPrerequisiteInUse)
+			}
+			state, err := u.rbac.auditRole(pair[0])
+			if err != nil {
+				return err
+			}
+			_, err = u.rbac.lockAssignment(&state, fmt.Sprintf("SELECT FALSE, condition_expr, valid_from, valid_until FROM %s WHERE user_id=? AND role_id=?", u.getTable()), userID, pair[0])
+			if err != nil {
+				return err
+			}
+
+			_, err = u.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id=? AND role_id=?", u.getTable()), userID, pair[0])
+			if err != nil {
+				return err
+			}
+
+			err = u.rbac.record(KindOwner, ActionUnassign, auditRecord{roleID: pair[0], owner: userID, before: state})
+			if err != nil {
+				return err
+			}
+
+			revoked[pair[0]] = true
+			pending = append(pending, pair[0])
+		}
+	}
+
+	return nil
+}
+
+func (u Users) prerequisiteError(userID Owner, roleID, prerequisiteID int64, err error) error {
+	role, pathErr := u.rbac.roles.GetPath(roleID)
+	if pathErr != nil {
+		return pathErr
+	}
+	prerequisite, pathErr := u.rbac.roles.GetPath(prerequisiteID)
+	if pathErr != nil {
+		return pathErr
+	}
+
+	return &PrerequisiteError{Owner: userID, Role: role, Prerequisite: prerequisite, Err: err}
+}
@@ -1,6 +1,7 @@
 package gorbac
 
 import (
+	"crypto/ed25519"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -18,25 +19,119 @@ type Config struct {
 	Port     int
 	Username string
 	Password string
+
+	// Hierarchy selects how the role and permission trees are stored.
+	Hierarchy Hierarchy
+
+	// Titles selects how titles shared by several nodes are handled.
+	Titles TitlePolicy
+
+	// Revocation selects what Users.Unassign does with roles whose
+	// prerequisite is revoked.
+	Revocation RevocationPolicy
+
+	// Sessions stores the sessions created by CreateSession.
+	// Defaults to a MemorySessionStore.
+	Sessions SessionStore
+
+	// Decisions configures logging of the decisions made by Check,
+	// CheckWithAttributes and Users.HasRole. New fails when the options
+	// do not validate.
+	Decisions DecisionLogOptions
+
+	// AuditKey signs the checkpoints written by Audit.Checkpoint.
+	// AuditPublicKey verifies them, and defaults to the public half of
+	// AuditKey, so auditors can verify without holding the private key.
+	AuditKey       ed25519.PrivateKey
+	AuditPublicKey ed25519.PublicKey
 }
 
+// Hierarchy is a storage strategy for the role and permission trees.
+type Hierarchy int
+
+// NestedSet keeps lft and rght values on every node. Reads are cheap, but
+// every insert rewrites about half of the table.
+// ClosureTable keeps a row for every ancestor-descendant pair in
+// role_paths and permission_paths. Inserts only write O(depth) rows.
+// Sibling ordering is not supported in closure table mode.
+const (
+	NestedSet Hierarchy = iota
+	ClosureTable
+)
+
+// TitlePolicy controls whether a title may be used by more than one node
+// of the same tree.
+type TitlePolicy int
+
+// DetectAmbiguousTitles allows a title once per parent, and lookups by a
+// title that is used more than once fail with ErrAmbiguousTitle.
+// UniqueTitles rejects a title that is already used anywhere in the tree.
+const (
+	DetectAmbiguousTitles TitlePolicy = iota
+	UniqueTitles
+)
+
 type Rbac struct {
 	permissions *Permissions
 	roles       *Roles
 	users       Owners // Default
 
 	extensions map[string]Owners
+	hierarchy  Hierarchy
+	titles     TitlePolicy
+	revocation RevocationPolicy
+	sessions   SessionStore
+	decisions  DecisionLogOptions
+	actor      string
+
+	auditKey       ed25519.PrivateKey
+	auditPublicKey ed25519.PublicKey
+
+	db   executor
+	conn *sql.DB
+}
+
+// executor is satisfied by both *sql.DB and *sql.Tx.
+type executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
 
-	db *sql.DB
+// BindableOwners is implemented by Owners extensions that run their queries
+// through the Rbac they are bound to, for example with Rbac.Exec. Bind returns
+// a copy of the extension that uses rbac. Only bindable extensions take part
+// in the transactions of Import and Apply.
+type BindableOwners interface {
+	Owners
+	Bind(rbac *Rbac) Owners
 }
 
 var (
 	ErrPermissionNotFound = errors.New("permission not found")
+	ErrUnboundExtension   = errors.New("owner extension cannot join a transaction")
+	ErrDenyPattern        = errors.New("a deny cannot target a permission pattern")
 )
 
 // New returns a new instance of Rbac
 func New(config *Config) *Rbac {
 	var rbac = new(Rbac)
+	rbac.hierarchy = config.Hierarchy
+	rbac.titles = config.Titles
+	rbac.revocation = config.Revocation
+	if err := config.Decisions.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	rbac.decisions = config.Decisions
+	rbac.auditKey = config.AuditKey
+	rbac.auditPublicKey = config.AuditPublicKey
+	if rbac.auditPublicKey == nil && rbac.auditKey != nil {
+		rbac.auditPublicKey = rbac.auditKey.Public().(ed25519.PublicKey)
+	}
+	rbac.sessions = config.Sessions
+	if rbac.sessions == nil {
+		rbac.sessions = NewMemorySessionStore()
+	}
 
 	rbac.roles = newRoleManager(rbac)
 	rbac.permissions = newPermissions(rbac)
@@ -50,10 +145,11 @@ func New(config *Config) *Rbac {
 	}
 
 	var err error
-	rbac.db, err = sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", config.Username, config.Password, config.Host, config.Port, config.Name))
+	rbac.conn, err = sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true", config.Username, config.Password, config.Host, config.Port, config.Name))
 	if err != nil {
 		log.Fatal(err)
 	}
+	rbac.db = rbac.conn
 
 	return rbac
 }
@@ -68,42 +164,171 @@ func (r *Rbac) AddOwnerExtension(name string, extension Owners) error {
 	return nil
 }
 
+// OwnerExtension returns the named extension. Its Assign enforces the member
+// limits set by Roles.SetMaxMembers, which only works for BindableOwners.
 func (r *Rbac) OwnerExtension(name string) Owners {
-	return r.extensions[name]
+	return r.limitMembers(r.extensions[name])
 }
 
 func (r *Rbac) DB() *sql.DB {
-	return r.db
+	return r.conn
+}
+
+// Exec, Query and QueryRow run a statement inside the transaction r is
+// bound to, if any. BindableOwners extensions use them for their queries.
+func (r Rbac) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.db.Exec(query, args...)
+}
+
+func (r Rbac) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return r.db.Query(query, args...)
+}
+
+func (r Rbac) QueryRow(query string, args ...interface{}) *sql.Row {
+	return r.db.QueryRow(query, args...)
+}
+
+// ownerExtension returns the named extension, refusing one that would run
+// outside the transaction r is bound to.
+func (r Rbac) ownerExtension(name string) (Owners, error) {
+	extension := r.extensions[name]
+	if extension == nil {
+		return nil, fmt.Errorf("unknown owner extension %q", name)
+	}
+
+	if _, ok := r.db.(*sql.Tx); ok {
+		if _, ok := extension.(BindableOwners); !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnboundExtension, name)
+		}
+	}
+
+	return r.limitMembers(extension), nil
+}
+
+// transaction runs fn with a copy of r whose queries all go through a single
+// database transaction. Nested calls reuse the running transaction.
+func (r Rbac) transaction(fn func(tx *Rbac) error) error {
+	if _, ok := r.db.(*sql.Tx); ok {
+		return fn(&r)
+	}
+
+	tx, err := r.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	r.db = tx
+	if err := fn(r.bind()); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// bind returns a copy of r whose managers and bindable owner extensions
+// refer to the copy, so that they pick up its database handle and actor.
+func (r Rbac) bind() *Rbac {
+	var bound = r
+	bound.roles = newRoleManager(&bound)
+	bound.permissions = newPermissions(&bound)
+	bound.users = newUsers(&bound)
+
+	bound.extensions = make(map[string]Owners, len(r.extensions))
+	for name, extension := range r.extensions {
+		if bindable, ok := extension.(BindableOwners); ok {
+			extension = bindable.Bind(&bound)
+		}
+		bound.extensions[name] = extension
+	}
+
+	return &bound
 }
 
 // Assign a role to a permission.
 // Returns true if successful, false if unsuccessful.
+// The permission can also be a pattern such as "/projects/*/read" or
+// "/billing/**", which grants every permission path it matches.
 func (r Rbac) Assign(role RoleInterface, permission PermissionInterface) (int64, error) {
+	return r.assign(role, permission, false, AssignmentOptions{})
+}
+
+// AssignWithCondition assigns a role to a permission that only applies while
+// condition holds for the attributes passed to CheckWithAttributes. Check
+// passes no attributes, so it never counts the assignment.
+// The condition is validated before anything is stored.
+func (r Rbac) AssignWithCondition(role RoleInterface, permission PermissionInterface, condition Condition) (int64, error) {
+	return r.assign(role, permission, false, AssignmentOptions{Condition: condition})
+}
+
+// AssignWithOptions assigns a role to a permission with a condition and/or
+// a validity window.
+func (r Rbac) AssignWithOptions(role RoleInterface, permission PermissionInterface, options AssignmentOptions) (int64, error) {
+	return r.assign(role, permission, false, options)
+}
+
+// Deny explicitly withholds a permission, and everything below it, from a role.
+// When several grants apply, the one on the most specific permission wins,
+// and a deny overrides an allow on the same permission.
+func (r Rbac) Deny(role RoleInterface, permission PermissionInterface) (int64, error) {
+	if isPattern(permission) {
+		return 0, ErrDenyPattern
+	}
+	return r.assign(role, permission, true, AssignmentOptions{})
+}
+
+func (r Rbac) assign(role RoleInterface, permission PermissionInterface, deny bool, options AssignmentOptions) (int64, error) {
 	var err error
 	var roleID int64
 	var permissionID int64
 
-	roleID, err = r.Roles().GetRoleID(role)
-	if err != nil {
+	if err = options.validate(); err != nil {
 		return 0, err
 	}
 
-	permissionID, err = r.permissions.GetPermissionID(permission)
+	roleID, err = r.Roles().GetRoleID(role)
 	if err != nil {
 		return 0, err
 	}
 
-	res, err := r.db.Exec("INSERT INTO role_permissions (role_id, permission_id, assignment_date) VALUES(?,?,?)", roleID, permissionID, time.Now().Nanosecond())
+	if !isPattern(permission) {
+		permissionID, err = r.permissions.GetPermissionID(permission)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var insertID int64
+	err = r.audited(KindGrant, ActionAssign, func(tx *Rbac, record *auditRecord) error {
+		state, err := tx.auditGrant(roleID, permissionID, permission)
+		if err != nil {
+			return err
+		}
+		state.Deny = deny
+		state.options(options)
+		record.roleID, record.permissionID, record.after = roleID, permissionID, state
+
+		if isPattern(permission) {
+			insertID, err = tx.assignPattern(roleID, permission.(string), options)
+			return err
+		}
+
+		res, err := tx.db.Exec("INSERT INTO role_permissions (role_id, permission_id, deny, condition_expr, valid_from, valid_until, assignment_date) VALUES(?,?,?,?,?,?,?)", roleID, permissionID, deny, options.Condition, nullTime(options.ValidFrom), nullTime(options.ValidUntil), time.Now().UTC())
+		if err != nil {
+			return err
+		}
+
+		insertID, _ = res.LastInsertId()
+		return nil
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	insertID, _ := res.LastInsertId()
-
 	return insertID, nil
 }
 
-// Unassign a Role-Permission relation.
+// Unassign a Role-Permission relation, allow or deny.
 func (r Rbac) Unassign(role RoleInterface, permission PermissionInterface) error {
 	var err error
 	var roleID int64
@@ -114,74 +339,205 @@ func (r Rbac) Unassign(role RoleInterface, permission PermissionInterface) error
 		return err
 	}
 
-	permissionID, err = r.permissions.GetPermissionID(permission)
-	if err != nil {
-		return err
+	if !isPattern(permission) {
+		permissionID, err = r.permissions.GetPermissionID(permission)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = r.db.Exec("DELETE FROM role_permissions WHERE role_id=? AND permission_id=?", roleID, permissionID)
+	return r.audited(KindGrant, ActionUnassign, func(tx *Rbac, record *auditRecord) error {
+		state, err := tx.auditGrant(roleID, permissionID, permission)
+		if err != nil {
+			return err
+		}
 
-	if err != nil {
-		return err
-	}
+		var found bool
+		if isPattern(permission) {
+			found, err = tx.lockAssignment(&state, "SELECT FALSE, condition_expr, valid_from, valid_until FROM role_permission_patterns WHERE role_id=? AND pattern=?", roleID, permission)
+		} else {
+			found, err = tx.lockAssignment(&state, "SELECT deny, condition_expr, valid_from, valid_until FROM role_permissions WHERE role_id=? AND permission_id=?", roleID, permissionID)
+		}
+		if err != nil {
+			return err
+		}
+		if !found {
+			record.skip = true
+			return nil
+		}
+		record.roleID, record.permissionID, record.before = roleID, permissionID, state
 
-	return nil
+		if isPattern(permission) {
+			return tx.unassignPattern(roleID, permission.(string))
+		}
+
+		_, err = tx.db.Exec("DELETE FROM role_permissions WHERE role_id=? AND permission_id=?", roleID, permissionID)
+		return err
+	})
 }
 
 // Check whether a user has a permission or not.
 // Returns true if a user has a permission, false if otherwise.
+// Assignments that carry a condition are left out, as there are no attributes
+// to evaluate it against; use CheckWithAttributes for those.
 func (r Rbac) Check(permission PermissionInterface, userID UserInterface) (bool, error) {
+	return r.CheckWithAttributes(permission, userID, nil)
+}
+
+// CheckWithAttributes checks whether a user has a permission, counting only
+// the conditional assignments whose condition holds for attrs.
+func (r Rbac) CheckWithAttributes(permission PermissionInterface, userID UserInterface, attrs Attributes) (bool, error) {
+	var start = time.Now()
+	roleID, err := r.grantingRole(permission, userID, attrs)
+
+	var decision = Decision{Operation: DecisionCheck, User: fmt.Sprint(userID), Permission: fmt.Sprint(permission)}
+	r.logDecision(decision, start, roleID != 0, err, roleID)
+
+	return roleID != 0, err
+}
+
+// check is CheckWithAttributes without decision logging, for internal checks.
+func (r Rbac) check(permission PermissionInterface, userID UserInterface, attrs Attributes) (bool, error) {
+	roleID, err := r.grantingRole(permission, userID, attrs)
+	return roleID != 0, err
+}
+
+// grantingRole returns the role assigned to userID through which the
+// permission is granted, or 0 when it is not granted.
+func (r Rbac) grantingRole(permission PermissionInterface, userID UserInterface, attrs Attributes) (int64, error) {
+	if err := checkUser(userID); err != nil {
+		return 0, err
+	}
+
+	permissionID, err := r.permissions.GetPermissionID(permission)
+	if err != nil {
+		return 0, err
+	}
+
+	if permissionID == 0 {
+		return 0, ErrPermissionNotFound
+	}
+
+	roleIDs, err := r.ownerRoles("user_roles", userID, attrs)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.permitted(roleIDs, permissionID, attrs)
+}
+
+// checkUser rejects empty user IDs.
+func checkUser(userID UserInterface) error {
 	if _, ok := userID.(string); ok {
 		if userID.(string) == "" {
-			return false, ErrUserRequired
+			return ErrUserRequired
 		}
 	} else if _, ok := userID.(int64); ok {
 		if userID.(int64) == 0 {
-			return false, ErrUserRequired
+			return ErrUserRequired
 		}
 	}
 
-	permissionID, err := r.permissions.GetPermissionID(permission)
+	return nil
+}
+
+// ownerRoles returns the active roles assigned directly to an owner whose
+// condition holds for attrs.
+func (r Rbac) ownerRoles(table string, owner Owner, attrs Attributes) ([]int64, error) {
+	query := fmt.Sprintf("SELECT role_id, condition_expr FROM %s AS TRel WHERE user_id=? AND %s", table, active("TRel"))
+	rows, err := r.db.Query(query, append([]interface{}{owner}, activeArgs()...)...)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roleIDs []int64
+	for rows.Next() {
+		var roleID int64
+		var condition Condition
+		if err := rows.Scan(&roleID, &condition); err != nil {
+			return nil, err
+		}
+		if condition.holds(attrs) {
+			roleIDs = append(roleIDs, roleID)
+		}
 	}
 
-	if permissionID == 0 {
-		return false, ErrPermissionNotFound
+	return roleIDs, rows.Err()
+}
+
+// permitted decides whether the roles, or the roles they cover, hold the
+// permission, and returns the given role the winning grant was reached
+// from, or 0 when the permission is not granted. Grants on the
+// permission or one of its ancestors, and matching patterns, are considered;
+// the most specific one wins and a deny beats an allow at the same depth.
+// Grants that are not active, or whose condition does not hold for attrs,
+// are skipped.
+func (r Rbac) permitted(roleIDs []int64, permissionID int64, attrs Attributes) (int64, error) {
+	roleID, _, err := r.decide(roleIDs, permissionID, attrs)
+	return roleID, err
+}
+
+// decide is permitted that also reports whether the winning grant is an
+// explicit deny.
+func (r Rbac) decide(roleIDs []int64, permissionID int64, attrs Attributes) (roleID int64, denied bool, err error) {
+	if len(roleIDs) == 0 {
+		return 0, false, nil
 	}
 
-	lastPart := `
-	ON ( TR.ID = TRel.role_id)
+	cte, args := r.roles.coverage(roleIDs)
+	query := fmt.Sprintf(`%s SELECT TP.%s, TRel.deny, TRel.condition_expr, covered.origin
+	FROM
+		role_permissions AS TRel
+	JOIN covered ON (covered.id=TRel.role_id)
+	JOIN permissions AS TP ON (TP.ID=TRel.permission_id)
+	JOIN permissions AS TPdirect ON (TPdirect.ID=?)
 	WHERE
-		TUrel.user_id=?
+		%s
 	AND
-		TPdirect.ID=?
-	`
-	query := fmt.Sprintf(`SELECT COUNT(*) AS Result
-	FROM
-		user_roles AS TUrel
-	JOIN roles AS TRdirect ON (TRdirect.ID=TUrel.role_id)
-	JOIN roles AS TR ON ( TR.Lft BETWEEN TRdirect.Lft AND TRdirect.Rght)
-	JOIN
-		(permissions AS TPdirect
-			JOIN permissions AS TP ON (TPdirect.Lft BETWEEN TP.Lft AND TP.Rght)
-			JOIN role_permissions AS TRel ON (TP.ID=TRel.permission_id)
-		) %s`, lastPart)
-
-	var result int64
-
-	err = r.db.QueryRow(query, userID, permissionID).Scan(&result)
+		%s
+	ORDER BY TP.%s DESC, TRel.deny DESC, covered.origin`, cte, Depth, r.permissions.entity.within("TPdirect", "TP"), active("TRel"), Depth)
+
+	args = append(args, permissionID)
+	rows, err := r.db.Query(query, append(args, activeArgs()...)...)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			return false, err
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	var depth int64 = -1
+	var deny bool
+	var origin int64
+	for rows.Next() {
+		var grantDepth, grantOrigin int64
+		var grantDeny bool
+		var condition Condition
+		if err := rows.Scan(&grantDepth, &grantDeny, &condition, &grantOrigin); err != nil {
+			return 0, false, err
 		}
+		if condition.holds(attrs) {
+			depth, deny, origin = grantDepth, grantDeny, grantOrigin
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, err
 	}
+	rows.Close()
 
-	if result > 0 {
-		return true, nil
+	patternDepth, patternOrigin, err := r.patternDepth(roleIDs, permissionID, attrs)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if patternDepth > depth {
+		return patternOrigin, false, nil
+	}
+	if depth >= 0 && !deny {
+		return origin, false, nil
 	}
 
-	return false, nil
+	return 0, deny, nil
 }
 
 // Reset all roles, permissions and assignments.
@@ -1,9 +1,14 @@
 package gorbac
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
 	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -133,7 +138,10 @@ func TestRemoveRoleRecursive(t *testing.T) {
 	_, err = rbacTest.Roles().Add("forum_moderator", "User can moderate forums", 0)
 	assert.Nil(t, err)
 
-	permissionID, err := rbacTest.Permissions().Add("edit_posts", "User can edit posts", 0)
+	_, err = rbacTest.Permissions().Add("edit_posts", "User can edit posts", 0)
+	assert.Equal(t, ErrDuplicateTitle, err)
+
+	permissionID, err := rbacTest.Permissions().GetPermissionID("edit_posts")
 	assert.Nil(t, err)
 
 	_, err = rbacTest.Assign("forum_moderator", "edit_posts")
@@ -159,6 +167,38 @@ func TestRemoveRoleRecursive(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestRemoveSubtreeAssignments(t *testing.T) {
+	childRoleID, err := rbacTest.Roles().AddPath("/removed/child", nil)
+	assert.Nil(t, err)
+	childPermissionID, err := rbacTest.Permissions().AddPath("/removed_grants/child", nil)
+	assert.Nil(t, err)
+	keptRoleID, err := rbacTest.Roles().AddPath("/removed_kept", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign(childRoleID, childPermissionID)
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign(keptRoleID, childPermissionID)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign(childRoleID, 106, nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().Remove("/removed", true)
+	assert.Nil(t, err)
+	err = rbacTest.Permissions().Remove("/removed_grants", true)
+	assert.Nil(t, err)
+
+	var count int64
+	err = rbacTest.DB().QueryRow("SELECT COUNT(*) FROM user_roles WHERE role_id=?", childRoleID).Scan(&count)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+	err = rbacTest.DB().QueryRow("SELECT COUNT(*) FROM role_permissions WHERE role_id=? OR permission_id=?", childRoleID, childPermissionID).Scan(&count)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+
+	err = rbacTest.Roles().Remove(keptRoleID, false)
+	assert.Nil(t, err)
+}
+
 func TestDepth(t *testing.T) {
 	_, err := rbacTest.Roles().AddPath("/my1/testpath/test1", nil)
 	assert.Nil(t, err)
@@ -223,3 +263,1230 @@ func TestChildren(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 3, len(res))
 }
+
+func TestImport(t *testing.T) {
+	policy := `
+roles:
+  - path: /staff
+    description: Staff members
+  - path: /staff/editor
+    description: Can edit articles
+permissions:
+  - path: /articles/edit
+    description: Edit articles
+grants:
+  - role: /staff/editor
+    permission: /articles/edit
+owners:
+  - owner: "205"
+    role: /staff/editor
+`
+	err := rbacTest.Import(strings.NewReader(policy))
+	assert.Nil(t, err)
+
+	success, err := rbacTest.Check("/articles/edit", 205)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+}
+
+func TestImportInvalidPath(t *testing.T) {
+	policy := `{
+  "roles": [
+    {"path": "/staff"},
+    {"path": "staff/editor"}
+  ]
+}`
+	err := rbacTest.Import(strings.NewReader(policy))
+	assert.NotNil(t, err)
+
+	policyErr, ok := err.(*PolicyError)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 4, policyErr.Line)
+	assert.Equal(t, 5, policyErr.Column)
+}
+
+func TestImportRollback(t *testing.T) {
+	policy := `
+roles:
+  - path: /imported/partial
+grants:
+  - role: /imported/partial
+    permission: /imported/missing
+`
+	err := rbacTest.Import(strings.NewReader(policy))
+	assert.NotNil(t, err)
+
+	_, err = rbacTest.Roles().GetRoleID("/imported/partial")
+	assert.NotNil(t, err)
+}
+
+func TestExport(t *testing.T) {
+	var first, second bytes.Buffer
+
+	err := rbacTest.Export(&first, FormatYAML)
+	assert.Nil(t, err)
+
+	err = rbacTest.Export(&second, FormatYAML)
+	assert.Nil(t, err)
+	assert.Equal(t, first.String(), second.String())
+
+	policy, err := ParsePolicy(&first)
+	assert.Nil(t, err)
+
+	var found bool
+	for _, grant := range policy.Grants {
+		if grant.Role == "/staff/editor" && grant.Permission == "/articles/edit" {
+			found = true
+		}
+	}
+	assert.Equal(t, true, found)
+}
+
+func TestPlanApply(t *testing.T) {
+	desired, err := rbacTest.Dump()
+	assert.Nil(t, err)
+
+	plan, err := rbacTest.Plan(desired)
+	assert.Nil(t, err)
+	assert.Equal(t, true, plan.Empty())
+
+	for i, role := range desired.Roles {
+		if role.Path == "/staff/editor" {
+			desired.Roles[i] = PolicyNode{Path: "/newsroom/editor", From: "/staff/editor", Description: role.Description}
+		}
+	}
+	for i, grant := range desired.Grants {
+		if grant.Role == "/staff/editor" {
+			desired.Grants[i].Role = "/newsroom/editor"
+		}
+	}
+	for i, owner := range desired.Owners {
+		if owner.Role == "/staff/editor" {
+			desired.Owners[i].Role = "/newsroom/editor"
+		}
+	}
+
+	plan, err = rbacTest.Plan(desired)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(plan.Changes))
+
+	err = rbacTest.Apply(plan)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().GetRoleID("/newsroom/editor")
+	assert.Nil(t, err)
+
+	success, err := rbacTest.Check("/articles/edit", 205)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+}
+
+func TestPlanMoveAndRename(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/plan_from/x", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/plan_to/x", nil)
+	assert.Nil(t, err)
+
+	desired, err := rbacTest.Dump()
+	assert.Nil(t, err)
+	for i, role := range desired.Roles {
+		if role.Path == "/plan_from/x" {
+			desired.Roles[i] = PolicyNode{Path: "/plan_to/y", From: "/plan_from/x"}
+		}
+	}
+
+	plan, err := rbacTest.Plan(desired)
+	assert.Nil(t, err)
+	err = rbacTest.Apply(plan)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().GetRoleID("/plan_to/y")
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().GetRoleID("/plan_to/x")
+	assert.Nil(t, err)
+}
+
+// unboundOwners hides the Bind method of the Owners it wraps.
+type unboundOwners struct {
+	Owners
+}
+
+func TestImportUnboundExtension(t *testing.T) {
+	var r = *rbacTest
+	r.extensions = map[string]Owners{"users": rbacTest.Users(), "legacy": unboundOwners{rbacTest.Users()}}
+
+	policy := `
+roles:
+  - path: /unbound
+owners:
+  - owner: "230"
+    role: /unbound
+    extension: legacy
+`
+	err := r.Import(strings.NewReader(policy))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), ErrUnboundExtension.Error())
+	}
+
+	_, err = rbacTest.Roles().GetRoleID("/unbound")
+	assert.NotNil(t, err)
+}
+
+func TestMoveRole(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/forum/forum_admin", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/support", nil)
+	assert.Nil(t, err)
+
+	roleID, err := rbacTest.Roles().GetRoleID("/forum/forum_admin")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign(roleID, 305, nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().Move("/forum/forum_admin", "/support")
+	assert.Nil(t, err)
+
+	movedID, err := rbacTest.Roles().GetRoleID("/support/forum_admin")
+	assert.Nil(t, err)
+	assert.Equal(t, roleID, movedID)
+
+	success, err := rbacTest.Users().HasRole(movedID, 305)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	err = rbacTest.Roles().Move("/support", "/support/forum_admin")
+	assert.Equal(t, ErrMoveIntoSelf, err)
+}
+
+func TestSiblingOrder(t *testing.T) {
+	parentID, err := rbacTest.Roles().Add("ordered", "", 0)
+	assert.Nil(t, err)
+
+	secondID, err := rbacTest.Roles().Add("second", "", parentID)
+	assert.Nil(t, err)
+
+	firstID, err := rbacTest.Roles().InsertBefore("first", "", secondID)
+	assert.Nil(t, err)
+
+	thirdID, err := rbacTest.Roles().InsertAfter("third", "", secondID)
+	assert.Nil(t, err)
+
+	res, err := rbacTest.Roles().Descendants(false, parentID)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res))
+	assert.Equal(t, firstID, res[0].ID)
+	assert.Equal(t, thirdID, res[2].ID)
+
+	err = rbacTest.Roles().Reorder(parentID, []int64{thirdID, firstID, secondID})
+	assert.Nil(t, err)
+
+	res, err = rbacTest.Roles().Descendants(false, parentID)
+	assert.Nil(t, err)
+	assert.Equal(t, thirdID, res[0].ID)
+	assert.Equal(t, secondID, res[2].ID)
+
+	err = rbacTest.Roles().Reorder(parentID, []int64{thirdID, firstID})
+	assert.Equal(t, ErrReorderChildren, err)
+}
+
+func TestVerifyRebuild(t *testing.T) {
+	problems, err := rbacTest.Roles().Verify()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(problems))
+
+	roleID, err := rbacTest.Roles().GetRoleID("/support/forum_admin")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.DB().Exec("UPDATE roles SET rght = lft WHERE id=?", roleID)
+	assert.Nil(t, err)
+
+	problems, err = rbacTest.Roles().Verify()
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, len(problems))
+
+	err = rbacTest.Roles().Rebuild()
+	assert.Nil(t, err)
+
+	problems, err = rbacTest.Roles().Verify()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(problems))
+
+	entries, err := rbacTest.Audit().Query(AuditFilter{Kind: KindRole, Action: ActionRebuild})
+	assert.Nil(t, err)
+	if assert.NotEqual(t, 0, len(entries)) {
+		assert.Contains(t, string(entries[len(entries)-1].Before), "problems")
+	}
+
+	rebuiltID, err := rbacTest.Roles().GetRoleID("/support/forum_admin")
+	assert.Nil(t, err)
+	assert.Equal(t, roleID, rebuiltID)
+}
+
+func TestParentAndDepthAfterMove(t *testing.T) {
+	roleID, err := rbacTest.Roles().GetRoleID("/support/forum_admin")
+	assert.Nil(t, err)
+
+	parentID, err := rbacTest.Roles().GetRoleID("/my1/testpath")
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().Move(roleID, parentID)
+	assert.Nil(t, err)
+
+	result, err := rbacTest.Roles().ParentNode(roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, parentID, result)
+
+	depth, err := rbacTest.Roles().Depth(roleID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), depth)
+
+	problems, err := rbacTest.Roles().Verify()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(problems))
+}
+
+func TestRoleInheritance(t *testing.T) {
+	policy := `
+roles:
+  - path: /developer
+  - path: /approver
+  - path: /team_lead
+permissions:
+  - path: /code/commit
+  - path: /release/approve
+grants:
+  - role: /developer
+    permission: /code/commit
+  - role: /approver
+    permission: /release/approve
+owners:
+  - owner: "310"
+    role: /team_lead
+`
+	err := rbacTest.Import(strings.NewReader(policy))
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().AddInheritance("/team_lead", "/developer")
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().AddInheritance("/team_lead", "/approver")
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().AddInheritance("/developer", "/team_lead")
+	assert.Equal(t, ErrInheritanceCycle, err)
+
+	success, err := rbacTest.Check("/release/approve", 310)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = rbacTest.Users().HasRole("/developer", 310)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = rbacTest.Roles().HasPermission("/team_lead", "/code/commit")
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	err = rbacTest.Roles().RemoveInheritance("/team_lead", "/approver")
+	assert.Nil(t, err)
+
+	success, err = rbacTest.Check("/release/approve", 310)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+}
+
+func TestPlanInheritance(t *testing.T) {
+	desired, err := rbacTest.Dump()
+	assert.Nil(t, err)
+	assert.Contains(t, desired.Inheritance, PolicyInheritance{Senior: "/team_lead", Junior: "/developer"})
+
+	plan, err := rbacTest.Plan(desired)
+	assert.Nil(t, err)
+	assert.Equal(t, true, plan.Empty())
+
+	desired.Inheritance = append(desired.Inheritance, PolicyInheritance{Senior: "/team_lead", Junior: "/approver"})
+	plan, err = rbacTest.Plan(desired)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(plan.Changes))
+
+	err = rbacTest.Apply(plan)
+	assert.Nil(t, err)
+
+	success, err := rbacTest.Check("/release/approve", 310)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	desired.Inheritance = []PolicyInheritance{}
+	plan, err = rbacTest.Plan(desired)
+	assert.Nil(t, err)
+	err = rbacTest.Apply(plan)
+	assert.Nil(t, err)
+
+	success, err = rbacTest.Check("/code/commit", 310)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+}
+
+func TestTreeQueries(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/company/sales/east", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/company/sales/west", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/company/finance", nil)
+	assert.Nil(t, err)
+
+	companyID, err := rbacTest.Roles().GetRoleID("/company")
+	assert.Nil(t, err)
+	eastID, err := rbacTest.Roles().GetRoleID("/company/sales/east")
+	assert.Nil(t, err)
+
+	ancestors, err := rbacTest.Roles().Ancestors(eastID)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(ancestors))
+	assert.Equal(t, "root", ancestors[0].Title)
+	assert.Equal(t, "sales", ancestors[2].Title)
+	assert.Equal(t, int64(2), ancestors[2].Depth)
+
+	siblings, err := rbacTest.Roles().Siblings(eastID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(siblings))
+	assert.Equal(t, "west", siblings[0].Title)
+
+	leaves, err := rbacTest.Roles().Leaves(companyID)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(leaves))
+
+	size, err := rbacTest.Roles().SubtreeSize(companyID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+}
+
+func TestRender(t *testing.T) {
+	dot, err := rbacTest.Roles().Render(FormatDOT)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(dot, "digraph rbac {"))
+	assert.Contains(t, dot, `[label="sales"]`)
+
+	mermaid, err := rbacTest.Roles().Render(FormatMermaid, OverlayGrants, OverlayUserCounts)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(mermaid, "flowchart TD"))
+	assert.Contains(t, mermaid, "subgraph permissions")
+	assert.Contains(t, mermaid, "-.->")
+	assert.Contains(t, mermaid, "team_lead (1 users)")
+}
+
+func TestRename(t *testing.T) {
+	err := rbacTest.Roles().Rename("/company/sales/east", "west")
+	assert.Equal(t, ErrDuplicateTitle, err)
+
+	err = rbacTest.Roles().Rename("/company/sales/east", "north/east")
+	assert.Equal(t, ErrInvalidTitle, err)
+
+	err = rbacTest.Roles().Rename("/company/sales/east", "north")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().GetRoleID("/company/sales/north")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Roles().GetRoleID("/company/sales/east")
+	assert.Equal(t, ErrPathNotFound, err)
+}
+
+func TestAmbiguousTitle(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/forum/edit", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Permissions().AddPath("/wiki/edit", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Permissions().GetPermissionID("edit")
+	assert.True(t, errors.Is(err, ErrAmbiguousTitle))
+
+	var ambiguous *AmbiguousTitleError
+	assert.True(t, errors.As(err, &ambiguous))
+	assert.Equal(t, []string{"/forum/edit", "/wiki/edit"}, ambiguous.Paths)
+
+	_, err = rbacTest.Check("edit", 310)
+	assert.True(t, errors.Is(err, ErrAmbiguousTitle))
+
+	_, err = rbacTest.Permissions().GetPermissionID("/wiki/edit")
+	assert.Nil(t, err)
+}
+
+func TestPermissionPatterns(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/projects/web/read", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Permissions().AddPath("/projects/web/write", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/reader", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/reader", 320, nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("/reader", "/projects/*/read")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("/reader", "/projects/**a")
+	assert.Equal(t, ErrInvalidPattern, err)
+
+	success, err := rbacTest.Check("/projects/web/read", 320)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = rbacTest.Check("/projects/web/write", 320)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	err = rbacTest.Unassign("/reader", "/projects/*/read")
+	assert.Nil(t, err)
+
+	success, err = rbacTest.Check("/projects/web/read", 320)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	_, err = rbacTest.Assign("/reader", "/projects/[wv]eb/read")
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign("/reader", "/projects/we?/write")
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign("/reader", "/projects/[web")
+	assert.Equal(t, ErrInvalidPattern, err)
+
+	success, err = rbacTest.Check("/projects/web/read", 320)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+	success, err = rbacTest.Check("/projects/web/write", 320)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	err = rbacTest.Unassign("/reader", "/projects/[wv]eb/read")
+	assert.Nil(t, err)
+	err = rbacTest.Unassign("/reader", "/projects/we?/write")
+	assert.Nil(t, err)
+}
+
+func TestDeny(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/forum/ban", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Permissions().AddPath("/forum/ban/appeal", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Permissions().AddPath("/forum/post", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/moderator", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/moderator", 330, nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Assign("/moderator", "/forum")
+	assert.Nil(t, err)
+	_, err = rbacTest.Deny("/moderator", "/forum/ban")
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign("/moderator", "/forum/ban/appeal")
+	assert.Nil(t, err)
+
+	success, err := rbacTest.Check("/forum/post", 330)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = rbacTest.Check("/forum/ban", 330)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	success, err = rbacTest.Check("/forum/ban/appeal", 330)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = rbacTest.Roles().HasPermission("/moderator", "/forum/ban")
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	_, err = rbacTest.Deny("/moderator", "/forum/*")
+	assert.Equal(t, ErrDenyPattern, err)
+
+	mermaid, err := rbacTest.Roles().Render(FormatMermaid, OverlayGrants)
+	assert.Nil(t, err)
+	assert.Contains(t, mermaid, "-.-x")
+}
+
+func TestCheckResource(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/documents/edit", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/reviewer", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/reviewer", 340, nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.AssignUserResource(105, "/documents/edit", "document", 42)
+	assert.Nil(t, err)
+	_, err = rbacTest.AssignResource("/reviewer", "/documents", "document", 7)
+	assert.Nil(t, err)
+
+	success, err := rbacTest.CheckResource("/documents/edit", 105, "document", 42)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = rbacTest.CheckResource("/documents/edit", 105, "document", 43)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	success, err = rbacTest.CheckResource("/documents/edit", 340, "document", 7)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = rbacTest.Check("/documents/edit", 340)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	_, err = rbacTest.Deny("/reviewer", "/documents/edit")
+	assert.Nil(t, err)
+
+	success, err = rbacTest.CheckResource("/documents/edit", 340, "document", 7)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	err = rbacTest.Unassign("/reviewer", "/documents/edit")
+	assert.Nil(t, err)
+
+	err = rbacTest.UnassignUserResource(int64(0), "/documents/edit", "document", 42)
+	assert.Equal(t, ErrUserRequired, err)
+
+	err = rbacTest.UnassignUserResource(105, "/documents/edit", "document", 42)
+	assert.Nil(t, err)
+
+	success, err = rbacTest.CheckResource("/documents/edit", 105, "document", 42)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+}
+
+func TestPlanResources(t *testing.T) {
+	desired, err := rbacTest.Dump()
+	assert.Nil(t, err)
+	assert.Contains(t, desired.Resources, PolicyResource{Role: "/reviewer", Permission: "/documents", ResourceType: "document", ResourceID: "7"})
+
+	plan, err := rbacTest.Plan(desired)
+	assert.Nil(t, err)
+	assert.Equal(t, true, plan.Empty())
+
+	desired.Resources = append(desired.Resources, PolicyResource{User: "105", Permission: "/documents/edit", ResourceType: "document", ResourceID: "43"})
+	plan, err = rbacTest.Plan(desired)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(plan.Changes))
+
+	err = rbacTest.Apply(plan)
+	assert.Nil(t, err)
+
+	success, err := rbacTest.CheckResource("/documents/edit", 105, "document", 43)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	entries, err := rbacTest.Audit().Query(AuditFilter{Kind: KindResource, Action: ActionAssign, Owner: 105})
+	assert.Nil(t, err)
+	if assert.NotEqual(t, 0, len(entries)) {
+		assert.Contains(t, string(entries[len(entries)-1].After), `"resource_id":"43"`)
+	}
+}
+
+func TestCheckWithAttributes(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/articles/publish", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/publisher", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("/publisher", 350, Condition(`request.ip in "10.0.0.0/8"`))
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("/publisher", 351, `request.ip in "10.0.0.0/8"`)
+	assert.True(t, errors.Is(err, ErrInvalidMeta))
+
+	_, err = rbacTest.AssignWithCondition("/publisher", "/articles/publish", "time.hour >=")
+	assert.True(t, errors.Is(err, ErrInvalidCondition))
+
+	_, err = rbacTest.AssignWithCondition("/publisher", "/articles/publish", "time.hour >= 9 && time.hour < 17")
+	assert.Nil(t, err)
+
+	success, err := rbacTest.CheckWithAttributes("/articles/publish", 350, Attributes{"request.ip": "10.0.0.1", "time.hour": 10})
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	success, err = rbacTest.CheckWithAttributes("/articles/publish", 350, Attributes{"request.ip": "10.0.0.1", "time.hour": 20})
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	success, err = rbacTest.CheckWithAttributes("/articles/publish", 350, Attributes{"request.ip": "192.168.0.1", "time.hour": 10})
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	success, err = rbacTest.Check("/articles/publish", 350)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+}
+
+func TestAssignmentValidity(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/reports/view", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/auditor", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/contractor", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign("/auditor", "/reports/view")
+	assert.Nil(t, err)
+	_, err = rbacTest.AssignWithOptions("/contractor", "/reports/view", AssignmentOptions{ValidUntil: time.Now().Add(-time.Hour)})
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("/auditor", 360, AssignmentOptions{ValidFrom: time.Now().Add(time.Hour), ValidUntil: time.Now()})
+	assert.Equal(t, ErrInvalidValidity, err)
+
+	_, err = rbacTest.Users().Assign("/auditor", 360, AssignmentOptions{ValidUntil: time.Now().Add(-time.Minute)})
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/auditor", 361, AssignmentOptions{ValidFrom: time.Now().Add(time.Hour)})
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/contractor", 362, nil)
+	assert.Nil(t, err)
+
+	for _, user := range []int64{360, 361, 362} {
+		success, err := rbacTest.Check("/reports/view", user)
+		assert.Nil(t, err)
+		assert.Equal(t, false, success)
+	}
+
+	success, err := rbacTest.Users().HasRole("/auditor", int64(360))
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	roles, err := rbacTest.Users().AllRoles(int64(360), nil)
+	assert.Nil(t, err)
+	assert.Len(t, roles, 0)
+
+	purged, err := rbacTest.PurgeExpired()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), purged)
+
+	entries, err := rbacTest.Audit().Query(AuditFilter{Owner: 360, Action: ActionUnassign})
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Contains(t, string(entries[0].Before), `"valid_until"`)
+	}
+
+	count, err := rbacTest.Users().RoleCount(int64(361))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestSSDConstraints(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/payments/payment_creator", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/payments/payment_approver", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/treasurer", nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Constraints().AddSSD("payments", []RoleInterface{"/payments/payment_creator"}, 2)
+	assert.Equal(t, ErrInvalidConstraint, err)
+	_, err = rbacTest.Constraints().AddSSD("payments", []RoleInterface{"/payments", "/payments/payment_creator"}, 2)
+	assert.Equal(t, ErrInvalidConstraint, err)
+
+	_, err = rbacTest.Users().Assign("/payments/payment_creator", 370, nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/payments/payment_approver", 370, nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Constraints().AddSSD("payments", []RoleInterface{"/payments/payment_creator", "/payments/payment_approver"}, 2)
+	assert.Nil(t, err)
+	_, err = rbacTest.Constraints().AddSSD("payments", []RoleInterface{"/payments/payment_creator", "/treasurer"}, 2)
+	assert.Equal(t, ErrConstraintExists, err)
+
+	violations, err := rbacTest.Constraints().Violations()
+	assert.Nil(t, err)
+	if assert.Len(t, violations, 1) {
+		assert.Equal(t, "payments", violations[0].Constraint)
+		assert.Equal(t, "370", violations[0].Owner)
+	}
+
+	_, err = rbacTest.Users().Assign("/payments/payment_creator", 371, nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/payments/payment_approver", 371, nil)
+	assert.True(t, errors.Is(err, ErrSSDViolation))
+	_, err = rbacTest.Users().Assign("/payments", 371, nil)
+	assert.True(t, errors.Is(err, ErrSSDViolation))
+
+	_, err = rbacTest.Users().Assign("/treasurer", 371, nil)
+	assert.Nil(t, err)
+	err = rbacTest.Roles().AddInheritance("/treasurer", "/payments/payment_approver")
+	assert.True(t, errors.Is(err, ErrSSDViolation))
+
+	juniors, err := rbacTest.Roles().Juniors("/treasurer")
+	assert.Nil(t, err)
+	assert.Len(t, juniors, 0)
+
+	err = rbacTest.Constraints().RemoveSSD("payments")
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/payments/payment_approver", 371, nil)
+	assert.Nil(t, err)
+}
+
+func TestSessions(t *testing.T) {
+	_, err := rbacTest.Permissions().AddPath("/ledger/post", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/bookkeeper", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/ledger_auditor", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Assign("/bookkeeper", "/ledger/post")
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("/bookkeeper", 380, nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/ledger_auditor", 380, nil)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Constraints().AddDSD("ledger", []RoleInterface{"/bookkeeper", "/ledger_auditor"}, 2)
+	assert.Nil(t, err)
+
+	session, err := rbacTest.CreateSession(380)
+	assert.Nil(t, err)
+
+	success, err := session.Check("/ledger/post")
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	err = session.ActivateRole("/treasurer")
+	assert.Equal(t, ErrRoleNotAuthorized, err)
+
+	err = session.ActivateRole("/bookkeeper")
+	assert.Nil(t, err)
+
+	success, err = session.Check("/ledger/post")
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	err = session.ActivateRole("/ledger_auditor")
+	assert.True(t, errors.Is(err, ErrDSDViolation))
+
+	resumed, err := rbacTest.Session(session.ID())
+	assert.Nil(t, err)
+	err = resumed.DropRole("/bookkeeper")
+	assert.Nil(t, err)
+	err = resumed.ActivateRole("/ledger_auditor")
+	assert.Nil(t, err)
+
+	success, err = session.Check("/ledger/post")
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+
+	roles, err := session.ActiveRoles()
+	assert.Nil(t, err)
+	if assert.Len(t, roles, 1) {
+		assert.Equal(t, "ledger_auditor", roles[0].Title)
+	}
+
+	assert.Nil(t, session.Close())
+	_, err = rbacTest.Session(session.ID())
+	assert.Equal(t, ErrSessionNotFound, err)
+}
+
+func TestRoleCardinality(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/break_glass", nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().SetMaxMembers("/break_glass", -1)
+	assert.Equal(t, ErrInvalidMaxMembers, err)
+	err = rbacTest.Roles().SetMaxMembers("/break_glass", 2)
+	assert.Nil(t, err)
+
+	_, err = rbacTest.Users().Assign("/break_glass", 390, nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/break_glass", 391, nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/break_glass", 392, nil)
+	assert.Equal(t, ErrRoleFull, err)
+
+	cardinality, err := rbacTest.Roles().Cardinality("/break_glass")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), cardinality.MaxMembers)
+	assert.Equal(t, int64(2), cardinality.Members)
+	assert.Equal(t, int64(2), cardinality.Extensions["users"])
+
+	err = rbacTest.Users().Unassign("/break_glass", 391)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/break_glass", 392, nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().SetMaxMembers("/break_glass", 0)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/break_glass", 393, nil)
+	assert.Nil(t, err)
+}
+
+// rawOwners assigns roles without checking member limits itself.
+type rawOwners struct {
+	Users
+}
+
+func (o rawOwners) Bind(rbac *Rbac) Owners {
+	return rawOwners{o.Users.Bind(rbac).(Users)}
+}
+
+func (o rawOwners) Assign(role RoleInterface, owner Owner, _ interface{}) (int64, error) {
+	roleID, err := o.rbac.Roles().GetRoleID(role)
+	if err != nil {
+		return 0, err
+	}
+	res, err := o.rbac.Exec("INSERT INTO user_roles (user_id, role_id, assignment_date) VALUES(?,?,?)", owner, roleID, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func TestRoleCardinalityExtension(t *testing.T) {
+	var r = *rbacTest
+	r.extensions = map[string]Owners{"raw": rawOwners{rbacTest.Users().(Users)}}
+
+	_, err := r.Roles().AddPath("/on_call", nil)
+	assert.Nil(t, err)
+	err = r.Roles().SetMaxMembers("/on_call", 1)
+	assert.Nil(t, err)
+
+	_, err = r.OwnerExtension("raw").Assign("/on_call", 395, nil)
+	assert.Nil(t, err)
+	_, err = r.OwnerExtension("raw").Assign("/on_call", 396, nil)
+	assert.Equal(t, ErrRoleFull, err)
+
+	err = rbacTest.Users().Unassign("/on_call", 395)
+	assert.Nil(t, err)
+	err = rbacTest.Roles().SetMaxMembers("/on_call", 0)
+	assert.Nil(t, err)
+
+	r.extensions["legacy"] = unboundOwners{rbacTest.Users()}
+	_, err = r.OwnerExtension("legacy").Assign("/on_call", 397, nil)
+	assert.True(t, errors.Is(err, ErrUnboundExtension))
+}
+
+func TestPrerequisiteRoles(t *testing.T) {
+	_, err := rbacTest.Roles().AddPath("/employee", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/db_admin", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Roles().AddPath("/db_root", nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Roles().AddPrerequisite("/db_admin", "/db_admin")
+	assert.Equal(t, ErrInvalidPrerequisite, err)
+	err = rbacTest.Roles().AddPrerequisite("/db_admin", "/employee")
+	assert.Nil(t, err)
+	err = rbacTest.Roles().AddPrerequisite("/db_root", "/db_admin")
+	assert.Nil(t, err)
+	err = rbacTest.Roles().AddPrerequisite("/employee", "/db_root")
+	assert.Equal(t, ErrPrerequisiteCycle, err)
+
+	prerequisites, err := rbacTest.Roles().Prerequisites("/db_root")
+	assert.Nil(t, err)
+	if assert.Len(t, prerequisites, 1) {
+		assert.Equal(t, "db_admin", prerequisites[0].Title)
+	}
+
+	_, err = rbacTest.Users().Assign("/db_admin", 400, nil)
+	assert.True(t, errors.Is(err, ErrMissingPrerequisite))
+
+	_, err = rbacTest.Users().Assign("/employee", 400, nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/db_admin", 400, nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/db_root", 400, nil)
+	assert.Nil(t, err)
+
+	err = rbacTest.Users().Unassign("/employee", 400)
+	assert.True(t, errors.Is(err, ErrPrerequisiteInUse))
+	success, err := rbacTest.Users().HasRole("/employee", 400)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	cascade := *rbacTest
+	cascade.revocation = CascadeRevocation
+	err = newUsers(&cascade).Unassign("/employee", 400)
+	assert.Nil(t, err)
+
+	for _, role := range []string{"/employee", "/db_admin", "/db_root"} {
+		success, err := rbacTest.Users().HasRole(role, 400)
+		assert.Nil(t, err)
+		assert.Equal(t, false, success, role)
+	}
+
+	// A role that lacked its prerequisite before does not block revoking
+	// an unrelated role.
+	_, err = rbacTest.Roles().AddPath("/contractor", nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/contractor", 401, nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/employee", 401, nil)
+	assert.Nil(t, err)
+	_, err = rbacTest.Users().Assign("/db_admin", 401, nil)
+	assert.Nil(t, err)
+	employeeID, err := rbacTest.Roles().GetRoleID("/employee")
+	assert.Nil(t, err)
+	_, err = rbacTest.DB().Exec("DELETE FROM user_roles WHERE user_id=? AND role_id=?", 401, employeeID)
+	assert.Nil(t, err)
+
+	err = rbacTest.Users().Unassign("/contractor", 401)
+	assert.Nil(t, err)
+	err = newUsers(&cascade).Unassign("/db_admin", 401)
+	assert.Nil(t, err)
+}
+
+func TestAuditLog(t *testing.T) {
+	var alice = rbacTest.WithActor("alice")
+	var start = time.Now().Add(-time.Second)
+
+	roleID, err := alice.Roles().AddPath("/audited/editor", []string{"audited", "Edits things"})
+	assert.Nil(t, err)
+	permissionID, err := alice.Permissions().AddPath("/audited/publish", nil)
+	assert.Nil(t, err)
+
+	err = alice.Roles().Edit(roleID, "editor", "Edits everything")
+	assert.Nil(t, err)
+	_, err = alice.Assign(roleID, permissionID)
+	assert.Nil(t, err)
+	_, err = alice.Users().Assign(roleID, 410, Condition("time.hour >= 9"))
+	assert.Nil(t, err)
+	err = alice.Users().Unassign(roleID, 410)
+	assert.Nil(t, err)
+	err = alice.Users().Unassign(roleID, 410)
+	assert.Nil(t, err)
+
+	entries, err := rbacTest.Audit().Query(AuditFilter{Actor: "alice", RoleID: roleID})
+	assert.Nil(t, err)
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, string(entry.Kind)+" "+string(entry.Action))
+		assert.True(t, entry.Time.After(start))
+	}
+	assert.Equal(t, []string{"role add", "role edit", "grant assign", "owner assign", "owner unassign"}, actions)
+
+	if assert.Len(t, entries, 5) {
+		assert.JSONEq(t, `{"path":"/audited/editor","description":"Edits things"}`, string(entries[1].Before))
+		assert.JSONEq(t, `{"path":"/audited/editor","description":"Edits everything"}`, string(entries[1].After))
+		assert.JSONEq(t, `{"role":"/audited/editor","permission":"/audited/publish"}`, string(entries[2].After))
+		assert.Equal(t, "410", entries[4].Owner)
+		assert.JSONEq(t, `{"role":"/audited/editor","condition":"time.hour >= 9"}`, string(entries[4].Before))
+	}
+
+	entries, err = rbacTest.Audit().Query(AuditFilter{Owner: 410, Action: ActionAssign, Since: start})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	_, err = rbacTest.DB().Exec("DELETE FROM audit_log")
+	assert.NotNil(t, err)
+}
+
+func TestAuditPolicyChanges(t *testing.T) {
+	var bob = rbacTest.WithActor("bob")
+
+	seniorID, err := bob.Roles().AddPath("/audited_policy/senior", nil)
+	assert.Nil(t, err)
+	_, err = bob.Roles().AddPath("/audited_policy/junior", nil)
+	assert.Nil(t, err)
+
+	err = bob.Roles().AddInheritance(seniorID, "/audited_policy/junior")
+	assert.Nil(t, err)
+	err = bob.Roles().RemoveInheritance(seniorID, "/audited_policy/junior")
+	assert.Nil(t, err)
+	err = bob.Roles().RemoveInheritance(seniorID, "/audited_policy/junior")
+	assert.Nil(t, err)
+	err = bob.Roles().AddPrerequisite(seniorID, "/audited_policy/junior")
+	assert.Nil(t, err)
+	err = bob.Roles().RemovePrerequisite(seniorID, "/audited_policy/junior")
+	assert.Nil(t, err)
+	err = bob.Roles().SetMaxMembers(seniorID, 2)
+	assert.Nil(t, err)
+	err = bob.Roles().SetMaxMembers(seniorID, 2)
+	assert.Nil(t, err)
+
+	entries, err := rbacTest.Audit().Query(AuditFilter{Actor: "bob", RoleID: seniorID})
+	assert.Nil(t, err)
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, string(entry.Kind)+" "+string(entry.Action))
+	}
+	assert.Equal(t, []string{"role add", "inheritance assign", "inheritance unassign", "prerequisite assign", "prerequisite unassign", "role limit"}, actions)
+	if assert.Len(t, entries, 6) {
+		assert.JSONEq(t, `{"role":"/audited_policy/senior","other":"/audited_policy/junior"}`, string(entries[1].After))
+		assert.JSONEq(t, `{"role":"/audited_policy/senior","max_members":0}`, string(entries[5].Before))
+		assert.JSONEq(t, `{"role":"/audited_policy/senior","max_members":2}`, string(entries[5].After))
+	}
+
+	_, err = bob.Constraints().AddSSD("audited_ssd", []RoleInterface{seniorID, "/audited_policy/junior"}, 2)
+	assert.Nil(t, err)
+	err = bob.Constraints().RemoveSSD("audited_ssd")
+	assert.Nil(t, err)
+
+	entries, err = rbacTest.Audit().Query(AuditFilter{Actor: "bob", Kind: KindSSD})
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, ActionAdd, entries[0].Action)
+		assert.JSONEq(t, `{"name":"audited_ssd","cardinality":2,"roles":["/audited_policy/senior","/audited_policy/junior"]}`, string(entries[0].After))
+		assert.Equal(t, ActionRemove, entries[1].Action)
+		assert.JSONEq(t, string(entries[0].After), string(entries[1].Before))
+	}
+
+	err = bob.Roles().SetMaxMembers(seniorID, 0)
+	assert.Nil(t, err)
+}
+
+func TestDecisionLog(t *testing.T) {
+	var buffer = NewRingBufferLogger(10)
+	var logged = *rbacTest
+	logged.decisions = DecisionLogOptions{Logger: buffer, Redact: HashUser([]byte("key"))}
+	var r = logged.bind()
+
+	roleID, err := r.Roles().AddPath("/decisions/reader", nil)
+	assert.Nil(t, err)
+	permissionID, err := r.Permissions().AddPath("/decisions/read", nil)
+	assert.Nil(t, err)
+	_, err = r.Assign(roleID, permissionID)
+	assert.Nil(t, err)
+	_, err = r.Users().Assign("/decisions", 420, nil)
+	assert.Nil(t, err)
+
+	success, err := r.Check("/decisions/read", 420)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+	success, err = r.Check("/decisions/read", 421)
+	assert.Nil(t, err)
+	assert.Equal(t, false, success)
+	success, err = r.Users().HasRole("/decisions/reader", 420)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+
+	decisions := buffer.Decisions()
+	if assert.Len(t, decisions, 3) {
+		assert.Equal(t, DecisionCheck, decisions[0].Operation)
+		assert.Equal(t, "/decisions/read", decisions[0].Permission)
+		assert.Equal(t, "/decisions", decisions[0].MatchedRole)
+		assert.Equal(t, HashUser([]byte("key"))(Decision{User: "420"}).User, decisions[0].User)
+		assert.Equal(t, false, decisions[1].Result)
+		assert.Equal(t, "", decisions[1].MatchedRole)
+		assert.Equal(t, DecisionHasRole, decisions[2].Operation)
+		assert.Equal(t, "/decisions", decisions[2].MatchedRole)
+	}
+
+	success, err = rbacTest.Check("/decisions/read", 420)
+	assert.Nil(t, err)
+	assert.Equal(t, true, success)
+	assert.Len(t, buffer.Decisions(), 3)
+}
+
+// chainProblems drops the checkpoint problems of checkpoints that were not
+// made by the test, such as those signed with the keys of earlier runs.
+func chainProblems(problems []AuditProblem, checkpointID int64) []AuditProblem {
+	var own []AuditProblem
+	for _, problem := range problems {
+		if (problem.Kind == ProblemSignature || problem.Kind == ProblemCheckpoint) && problem.ID != checkpointID {
+			continue
+		}
+		own = append(own, problem)
+	}
+	return own
+}
+
+func TestAuditChain(t *testing.T) {
+	_, err := rbacTest.Audit().Checkpoint()
+	assert.Equal(t, ErrNoAuditKey, err)
+
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	var signed = *rbacTest
+	signed.auditKey = private
+	signed.auditPublicKey = public
+
+	roleID, err := signed.Roles().AddPath("/chained/auditor", nil)
+	assert.Nil(t, err)
+
+	entries, err := signed.Audit().Query(AuditFilter{RoleID: roleID})
+	assert.Nil(t, err)
+	if !assert.Len(t, entries, 1) {
+		return
+	}
+	assert.Len(t, entries[0].Hash, 64)
+	assert.NotEqual(t, "", entries[0].PrevHash)
+
+	checkpoint, err := signed.Audit().Checkpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, entries[0].ID, checkpoint.EntryID)
+	assert.Equal(t, entries[0].Hash, checkpoint.Hash)
+
+	problems, err := signed.Audit().Verify()
+	assert.Nil(t, err)
+	assert.Len(t, chainProblems(problems, checkpoint.ID), 0)
+
+	_, err = rbacTest.Audit().Verify()
+	assert.Equal(t, ErrNoAuditVerifier, err)
+
+	other, _, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	var forged = signed
+	forged.auditPublicKey = other
+	problems, err = forged.Audit().Verify()
+	assert.Nil(t, err)
+	problems = chainProblems(problems, checkpoint.ID)
+	if assert.Len(t, problems, 1) {
+		assert.Equal(t, ProblemSignature, problems[0].Kind)
+	}
+
+	// Tamper with an entry behind the library's back. The entry and the
+	// trigger are restored even when an assertion below fails.
+	_, err = rbacTest.DB().Exec("DROP TRIGGER audit_log_no_update")
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_, err := rbacTest.DB().Exec("UPDATE audit_log SET actor=? WHERE ID=?", entries[0].Actor, entries[0].ID)
+		assert.Nil(t, err)
+		_, err = rbacTest.DB().Exec("DROP TRIGGER IF EXISTS audit_log_no_update")
+		assert.Nil(t, err)
+		_, err = rbacTest.DB().Exec("CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_log is append-only'")
+		assert.Nil(t, err)
+	})
+
+	_, err = rbacTest.DB().Exec("UPDATE audit_log SET actor='mallory' WHERE ID=?", entries[0].ID)
+	assert.Nil(t, err)
+
+	problems, err = signed.Audit().Verify()
+	assert.Nil(t, err)
+	problems = chainProblems(problems, checkpoint.ID)
+	if assert.Len(t, problems, 1) {
+		assert.Equal(t, ProblemEntryHash, problems[0].Kind)
+		assert.Equal(t, entries[0].ID, problems[0].ID)
+	}
+
+	_, err = rbacTest.DB().Exec("UPDATE audit_log SET actor=? WHERE ID=?", entries[0].Actor, entries[0].ID)
+	assert.Nil(t, err)
+
+	problems, err = signed.Audit().Verify()
+	assert.Nil(t, err)
+	assert.Len(t, chainProblems(problems, checkpoint.ID), 0)
+
+	// An entry written without a hash after the chain started is flagged.
+	_, err = rbacTest.DB().Exec("DROP TRIGGER IF EXISTS audit_log_no_delete")
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_, err := rbacTest.DB().Exec("DROP TRIGGER IF EXISTS audit_log_no_delete")
+		assert.Nil(t, err)
+		_, err = rbacTest.DB().Exec("CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_log is append-only'")
+		assert.Nil(t, err)
+	})
+
+	res, err := rbacTest.DB().Exec("INSERT INTO audit_log (actor, created_at, kind, action) VALUES('mallory', ?, 'role', 'add')", time.Now().UTC())
+	assert.Nil(t, err)
+	unhashedID, _ := res.LastInsertId()
+	t.Cleanup(func() {
+		_, err := rbacTest.DB().Exec("DELETE FROM audit_log WHERE ID=?", unhashedID)
+		assert.Nil(t, err)
+	})
+
+	problems, err = signed.Audit().Verify()
+	assert.Nil(t, err)
+	var unchained bool
+	for _, problem := range problems {
+		if problem.Kind == ProblemUnchained && problem.ID == unhashedID {
+			unchained = true
+		}
+	}
+	assert.True(t, unchained)
+}
@@ -0,0 +1,257 @@
+package gorbac
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GraphFormat selects the diagram language used by Render.
+type GraphFormat string
+
+// Supported graph formats
+const (
+	FormatDOT     GraphFormat = "dot"
+	FormatMermaid GraphFormat = "mermaid"
+)
+
+// Overlay adds extra information to a rendered tree.
+type Overlay int
+
+// OverlayGrants draws both trees and a dashed edge for every role-permission
+// grant; denials end in a bar instead of an arrow, and are red in DOT.
+// OverlayUserCounts adds the number of owners assigned to each role, summed
+// over every owner extension, to the role labels.
+const (
+	OverlayGrants Overlay = iota
+	OverlayUserCounts
+)
+
+// Render draws the role tree as a DOT or Mermaid diagram.
+func (r Roles) Render(format GraphFormat, overlays ...Overlay) (string, error) {
+	return r.rbac.render(format, true, hasOverlay(overlays, OverlayGrants), hasOverlay(overlays, OverlayUserCounts))
+}
+
+// Render draws the permission tree as a DOT or Mermaid diagram.
+func (p Permissions) Render(format GraphFormat, overlays ...Overlay) (string, error) {
+	grants := hasOverlay(overlays, OverlayGrants)
+	return p.rbac.render(format, grants, true, grants && hasOverlay(overlays, OverlayUserCounts))
+}
+
+func hasOverlay(overlays []Overlay, overlay Overlay) bool {
+	for _, o := range overlays {
+		if o == overlay {
+			return true
+		}
+	}
+	return false
+}
+
+type graphNode struct {
+	id     string
+	label  string
+	parent string
+}
+
+// graphGrant is a role-permission edge drawn by OverlayGrants.
+type graphGrant struct {
+	role       string
+	permission string
+	deny       bool
+}
+
+type graphTree struct {
+	name  string
+	nodes []graphNode
+}
+
+func (r Rbac) render(format GraphFormat, roles, permissions, userCounts bool) (string, error) {
+	if format != FormatDOT && format != FormatMermaid {
+		return "", fmt.Errorf("unknown graph format: %v", format)
+	}
+
+	var counts map[int64]int64
+	if userCounts {
+		var err error
+		counts, err = r.userCounts()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var trees []graphTree
+	if roles {
+		tree, err := r.graphTree("roles", "r", r.roles.entity, counts)
+		if err != nil {
+			return "", err
+		}
+		trees = append(trees, tree)
+	}
+	if permissions {
+		tree, err := r.graphTree("permissions", "p", r.permissions.entity, nil)
+		if err != nil {
+			return "", err
+		}
+		trees = append(trees, tree)
+	}
+
+	var known = make(map[string]bool)
+	for _, tree := range trees {
+		for _, n := range tree.nodes {
+			known[n.id] = true
+		}
+	}
+
+	var grants []graphGrant
+	if roles && permissions {
+		rows, err := r.db.Query("SELECT role_id, permission_id, deny FROM role_permissions ORDER BY role_id, permission_id")
+		if err != nil {
+			return "", err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var roleID, permissionID int64
+			var deny bool
+			if err := rows.Scan(&roleID, &permissionID, &deny); err != nil {
+				return "", err
+			}
+			grant := graphGrant{role: fmt.Sprintf("r%d", roleID), permission: fmt.Sprintf("p%d", permissionID), deny: deny}
+			if known[grant.role] && known[grant.permission] {
+				grants = append(grants, grant)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+	}
+
+	var b strings.Builder
+	if format == FormatDOT {
+		writeDOT(&b, trees, grants)
+	} else {
+		writeMermaid(&b, trees, grants)
+	}
+
+	return b.String(), nil
+}
+
+// graphTree lists the root and every node below it in depth-first order.
+func (r Rbac) graphTree(name, prefix string, e entityInternal, counts map[int64]int64) (graphTree, error) {
+	var tree = graphTree{name: name}
+
+	descendants, err := e.descendants(true, r.rootID())
+	if err != nil {
+		return tree, err
+	}
+
+	label := func(id int64, title string) string {
+		if counts == nil {
+			return title
+		}
+		return fmt.Sprintf("%s (%d users)", title, counts[id])
+	}
+
+	var rootID = fmt.Sprintf("%s%d", prefix, r.rootID())
+	tree.nodes = append(tree.nodes, graphNode{id: rootID, label: label(r.rootID(), "root")})
+
+	var stack = []string{rootID}
+	for _, d := range descendants {
+		id := fmt.Sprintf("%s%d", prefix, d.ID)
+		stack = append(stack[:d.Depth], id)
+		tree.nodes = append(tree.nodes, graphNode{id: id, label: label(d.ID, d.Title), parent: stack[d.Depth-1]})
+	}
+
+	return tree, nil
+}
+
+func (r Rbac) userCounts() (map[int64]int64, error) {
+	var counts = make(map[int64]int64)
+	for _, extension := range r.extensions {
+		if err := r.addOwnerCounts(counts, extension.Table()); err != nil {
+			return nil, err
+		}
+	}
+
+	return counts, nil
+}
+
+func (r Rbac) addOwnerCounts(counts map[int64]int64, table string) error {
+	rows, err := r.db.Query(fmt.Sprintf("SELECT role_id, COUNT(*) FROM %s GROUP BY role_id", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roleID, count int64
+		if err := rows.Scan(&roleID, &count); err != nil {
+			return err
+		}
+		counts[roleID] += count
+	}
+
+	return rows.Err()
+}
+
+func writeDOT(b *strings.Builder, trees []graphTree, grants []graphGrant) {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+	b.WriteString("digraph rbac {\n")
+	for _, tree := range trees {
+		indent := "\t"
+		if len(trees) > 1 {
+			fmt.Fprintf(b, "\tsubgraph cluster_%s {\n\t\tlabel=\"%s\";\n", tree.name, tree.name)
+			indent = "\t\t"
+		}
+		for _, n := range tree.nodes {
+			fmt.Fprintf(b, "%s%s [label=\"%s\"];\n", indent, n.id, quote.Replace(n.label))
+		}
+		for _, n := range tree.nodes {
+			if n.parent != "" {
+				fmt.Fprintf(b, "%s%s -> %s;\n", indent, n.parent, n.id)
+			}
+		}
+		if len(trees) > 1 {
+			b.WriteString("\t}\n")
+		}
+	}
+	for _, grant := range grants {
+		if grant.deny {
+			fmt.Fprintf(b, "\t%s -> %s [style=dashed, color=red, arrowhead=tee];\n", grant.role, grant.permission)
+			continue
+		}
+		fmt.Fprintf(b, "\t%s -> %s [style=dashed];\n", grant.role, grant.permission)
+	}
+	b.WriteString("}\n")
+}
+
+func writeMermaid(b *strings.Builder, trees []graphTree, grants []graphGrant) {
+	quote := strings.NewReplacer(`"`, "#quot;")
+
+	b.WriteString("flowchart TD\n")
+	for _, tree := range trees {
+		indent := "\t"
+		if len(trees) > 1 {
+			fmt.Fprintf(b, "\tsubgraph %s\n", tree.name)
+			indent = "\t\t"
+		}
+		for _, n := range tree.nodes {
+			fmt.Fprintf(b, "%s%s[\"%s\"]\n", indent, n.id, quote.Replace(n.label))
+		}
+		for _, n := range tree.nodes {
+			if n.parent != "" {
+				fmt.Fprintf(b, "%s%s --> %s\n", indent, n.parent, n.id)
+			}
+		}
+		if len(trees) > 1 {
+			b.WriteString("\tend\n")
+		}
+	}
+	for _, grant := range grants {
+		if grant.deny {
+			fmt.Fprintf(b, "\t%s -.-x %s\n", grant.role, grant.permission)
+			continue
+		}
+		fmt.Fprintf(b, "\t%s -.-> %s\n", grant.role, grant.permission)
+	}
+}
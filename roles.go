@@ -1,6 +1,7 @@
 package gorbac
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 )
@@ -29,7 +30,7 @@ func newRoleManager(r *Rbac) *Roles {
 	var Roles = new(Roles)
 	Roles.table = "roles"
 	Roles.rbac = r
-	Roles.entity = &entity{rbac: r, entityHolder: Roles}
+	Roles.entity = newEntity(r, Roles)
 	return Roles
 }
 
@@ -59,40 +60,8 @@ func (r Roles) HasPermission(role RoleInterface, permission PermissionInterface)
 		return false, err
 	}
 
-	query := fmt.Sprintf(`
-		SELECT COUNT(*) AS Result
-		FROM role_permissions AS TRel
-		JOIN permissions AS TP ON ( TP.ID= TRel.permission_id)
-		JOIN roles AS TR ON ( TR.ID = TRel.role_id)
-		WHERE TR.Lft BETWEEN
-			(SELECT Lft FROM roles WHERE ID=?)
-			AND
-			(SELECT Rght FROM roles WHERE ID=?)
-
-			/* the above section means any row that is a descendants of our role (if descendant roles have some permission, then our role has it two) */
-
-			AND TP.ID IN (
-				SELECT parent.ID
-				FROM 
-				permissions AS node,
-				permissions AS parent
-			WHERE node.Lft BETWEEN parent.Lft AND parent.Rght
-			AND ( node.ID=? )
-			ORDER BY parent.Lft
-		);
-	`)
-
-	var result int64
-	err = r.rbac.db.QueryRow(query, roleID, roleID, permissionID).Scan(&result)
-	if err != nil {
-		return false, err
-	}
-
-	if result > 0 {
-		return true, nil
-	}
-
-	return false, nil
+	grantedBy, err := r.rbac.permitted([]int64{roleID}, permissionID, nil)
+	return grantedBy != 0, err
 }
 
 // Remove Roles from system.
@@ -106,24 +75,134 @@ func (r Roles) Remove(role RoleInterface, recursive bool) error {
 		return err
 	}
 
-	r.UnassignPermissions(role)
-	r.UnassignUsers(role)
+	_, err = r.rbac.auditedNode(KindRole, ActionRemove, roleID, func(tx *Rbac) (int64, error) {
+		return roleID, tx.roles.remove(roleID, recursive)
+	})
+	return err
+}
+
+func (r Roles) remove(roleID int64, recursive bool) error {
+	roleIDs, err := subtreeIDs(r.entity, roleID, recursive)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range roleIDs {
+		if err = r.UnassignPermissions(id); err != nil {
+			return err
+		}
+		if err = r.UnassignUsers(id); err != nil {
+			return err
+		}
+		if err = r.removeInheritance(id); err != nil {
+			return err
+		}
+		if err = r.rbac.Constraints().removeRole(id); err != nil {
+			return err
+		}
+		if err = r.removePrerequisites(id); err != nil {
+			return err
+		}
+	}
 
 	if recursive {
-		r.entity.deleteSubtreeConditional(roleID)
-	} else {
-		r.entity.deleteConditional(roleID)
+		return r.entity.deleteSubtreeConditional(roleID)
 	}
 
-	return nil
+	return r.entity.deleteConditional(roleID)
+}
+
+// Rename gives the Role at path a new title. The title has to be unique
+// among its siblings, so the renamed path cannot clash with an existing one.
+func (r Roles) Rename(path string, title string) error {
+	id, err := r.GetRoleID(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.rbac.auditedNode(KindRole, ActionRename, id, func(tx *Rbac) (int64, error) {
+		return id, rename(tx.roles.entity, path, title)
+	})
+	return err
+}
+
+// Move relocates a Role and its descendants below a new parent.
+// IDs and assignments are kept. A Role cannot be moved below itself, or
+// below a Role whose users would then break a separation of duty constraint.
+func (r Roles) Move(role RoleInterface, parent RoleInterface) error {
+	roleID, err := r.GetRoleID(role)
+	if err != nil {
+		return err
+	}
+
+	parentID, err := r.GetRoleID(parent)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.rbac.auditedNode(KindRole, ActionMove, roleID, func(tx *Rbac) (int64, error) {
+		return roleID, tx.Constraints().guard(parentID, func(tx *Rbac) error {
+			return tx.roles.entity.move(roleID, parentID, "")
+		})
+	})
+	return err
+}
+
+// InsertBefore adds a Role as the sibling directly before another Role.
+func (r Roles) InsertBefore(title string, description string, sibling RoleInterface) (int64, error) {
+	siblingID, err := r.GetRoleID(sibling)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.rbac.auditedNode(KindRole, ActionAdd, 0, func(tx *Rbac) (int64, error) {
+		return tx.roles.entity.insertBefore(title, description, siblingID)
+	})
+}
+
+// InsertAfter adds a Role as the sibling directly after another Role.
+func (r Roles) InsertAfter(title string, description string, sibling RoleInterface) (int64, error) {
+	siblingID, err := r.GetRoleID(sibling)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.rbac.auditedNode(KindRole, ActionAdd, 0, func(tx *Rbac) (int64, error) {
+		return tx.roles.entity.insertAfter(title, description, siblingID)
+	})
+}
+
+// Reorder arranges the children of a Role in the order of ids.
+// Every child has to be listed exactly once.
+func (r Roles) Reorder(parent RoleInterface, ids []int64) error {
+	parentID, err := r.GetRoleID(parent)
+	if err != nil {
+		return err
+	}
+
+	return r.rbac.reorderTree(KindRole, parentID, ids)
+}
+
+// Verify checks the nested set of the role tree and returns every problem found.
+func (r Roles) Verify() ([]TreeProblem, error) {
+	return r.entity.verify()
+}
+
+// Rebuild recomputes the nested set of the role tree. IDs and assignments are kept.
+func (r Roles) Rebuild() error {
+	return r.rbac.rebuildTree(KindRole)
 }
 
 func (r Roles) Add(title string, description string, parentID int64) (int64, error) {
-	return r.entity.add(title, description, parentID)
+	return r.rbac.auditedNode(KindRole, ActionAdd, 0, func(tx *Rbac) (int64, error) {
+		return tx.roles.entity.add(title, description, parentID)
+	})
 }
 
 func (r Roles) AddPath(path string, description []string) (int64, error) {
-	return r.entity.addPath(path, description)
+	return r.rbac.auditedNode(KindRole, ActionAdd, 0, func(tx *Rbac) (int64, error) {
+		return tx.roles.entity.addPath(path, description)
+	})
 }
 
 func (r Roles) TitleID(title string) (int64, error) {
@@ -131,7 +210,17 @@ func (r Roles) TitleID(title string) (int64, error) {
 }
 
 func (r Roles) Reset(ensure bool) error {
-	return r.entity.reset(ensure)
+	if err := r.entity.reset(ensure); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"role_inheritance", "ssd_constraint_roles", "ssd_constraints", "dsd_constraint_roles", "dsd_constraints", "role_prerequisites"} {
+		if _, err := r.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s", table)); err != nil {
+			return err
+		}
+	}
+
+	return r.rbac.record(KindRole, ActionReset, auditRecord{})
 }
 
 func (r Roles) getTable() string {
@@ -139,7 +228,11 @@ func (r Roles) getTable() string {
 }
 
 func (r Roles) ResetAssignments(ensure bool) error {
-	return r.entity.resetAssignments(ensure)
+	if err := r.entity.resetAssignments(ensure); err != nil {
+		return err
+	}
+
+	return r.rbac.record(KindGrant, ActionReset, auditRecord{})
 }
 
 func (r Roles) Permissions(role RoleInterface) ([]permission, error) {
@@ -153,7 +246,7 @@ func (r Roles) Permissions(role RoleInterface) ([]permission, error) {
 
 	query := fmt.Sprintf(`
 	SELECT 
-		TP.ID, TP.Title, TP.Description 
+		TP.ID, TP.Title, TP.Description, TR.deny
 	FROM permissions AS TP
 	LEFT JOIN role_permissions AS TR ON (TR.permission_id=TP.ID)
 	WHERE role_id=? ORDER BY TP.ID`)
@@ -167,7 +260,7 @@ func (r Roles) Permissions(role RoleInterface) ([]permission, error) {
 	var permissions []permission
 	for rows.Next() {
 		var permission permission
-		err := rows.Scan(&permission.ID, &permission.Title, &permission.Description)
+		err := rows.Scan(&permission.ID, &permission.Title, &permission.Description, &permission.Deny)
 		if err != nil {
 			return nil, err
 		}
@@ -193,6 +286,16 @@ func (r Roles) UnassignPermissions(role RoleInterface) error {
 		return err
 	}
 
+	_, err = r.rbac.db.Exec("DELETE FROM role_permission_patterns WHERE role_id=?", roleID)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.rbac.db.Exec("DELETE FROM role_resource_permissions WHERE role_id=?", roleID)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -258,7 +361,10 @@ func (r Roles) Depth(id int64) (int64, error) {
 }
 
 func (r Roles) Edit(id int64, title, description string) error {
-	return r.entity.edit(id, title, description)
+	_, err := r.rbac.auditedNode(KindRole, ActionEdit, id, func(tx *Rbac) (int64, error) {
+		return id, tx.roles.entity.edit(id, title, description)
+	})
+	return err
 }
 
 func (r Roles) ParentNode(id int64) (int64, error) {
@@ -270,11 +376,41 @@ func (r Roles) ReturnID(entity string) (int64, error) {
 }
 
 // Descendants returns descendants of an Entity, with their depths in integer.
-func (r Roles) Descendants(absolute bool, id int64) ([]path, error) {
+func (r Roles) Descendants(absolute bool, id int64) ([]Node, error) {
 	return r.entity.descendants(absolute, id)
 }
 
-// Children returns children of an Entity.
-func (r Roles) Children(id int64) ([]path, error) {
+// Children returns all descendants of an Entity, with their depths relative
+// to it.
+func (r Roles) Children(id int64) ([]Node, error) {
 	return r.entity.children(id)
 }
+
+// Ancestors returns the ancestors of an Entity, starting at the root.
+func (r Roles) Ancestors(id int64) ([]Node, error) {
+	result, err := r.entity.pathConditional(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return result[:len(result)-1], nil
+}
+
+// Siblings returns the other children of an Entity's parent.
+func (r Roles) Siblings(id int64) ([]Node, error) {
+	return r.entity.siblings(id)
+}
+
+// Leaves returns the nodes without children in the subtree of an Entity.
+func (r Roles) Leaves(id int64) ([]Node, error) {
+	return r.entity.leaves(id)
+}
+
+// SubtreeSize returns the number of nodes in the subtree of an Entity,
+// including the Entity itself.
+func (r Roles) SubtreeSize(id int64) (int64, error) {
+	return r.entity.subtreeSize(id)
+}
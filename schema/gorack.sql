@@ -5,12 +5,15 @@ CREATE TABLE `permissions` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `lft` int(11) NOT NULL,
   `rght` int(11) NOT NULL,
+  `parent_id` int(11) NOT NULL DEFAULT '0',
+  `depth` int(11) NOT NULL DEFAULT '0',
   `title` char(64) CHARACTER SET utf8 NOT NULL,
   `description` text CHARACTER SET utf8 NOT NULL,
   PRIMARY KEY (`id`),
   KEY `title` (`title`),
   KEY `lft` (`lft`),
-  KEY `rght` (`rght`)
+  KEY `rght` (`rght`),
+  KEY `parent_id` (`parent_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
 
 
@@ -21,12 +24,64 @@ CREATE TABLE `permissions` (
 CREATE TABLE `role_permissions` (
   `role_id` int(11) NOT NULL,
   `permission_id` int(11) NOT NULL,
-  `assignment_date` int(11) NOT NULL,
+  `deny` tinyint(1) NOT NULL DEFAULT '0',
+  `condition_expr` varchar(1024) COLLATE utf8_bin NOT NULL DEFAULT '',
+  `valid_from` datetime DEFAULT NULL,
+  `valid_until` datetime DEFAULT NULL,
+  `assignment_date` datetime NOT NULL,
   PRIMARY KEY (`role_id`,`permission_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
 
 
 
+# Dump of table role_permission_patterns
+# Grants of wildcard permission paths such as /projects/*/read.
+# ------------------------------------------------------------
+
+CREATE TABLE `role_permission_patterns` (
+  `role_id` int(11) NOT NULL,
+  `pattern` varchar(255) COLLATE utf8_bin NOT NULL,
+  `condition_expr` varchar(1024) COLLATE utf8_bin NOT NULL DEFAULT '',
+  `valid_from` datetime DEFAULT NULL,
+  `valid_until` datetime DEFAULT NULL,
+  `assignment_date` datetime NOT NULL,
+  PRIMARY KEY (`role_id`,`pattern`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+
+
+# Dump of table role_resource_permissions
+# Grants of a permission on a single resource to a role.
+# ------------------------------------------------------------
+
+CREATE TABLE `role_resource_permissions` (
+  `role_id` int(11) NOT NULL,
+  `permission_id` int(11) NOT NULL,
+  `resource_type` varchar(64) COLLATE utf8_bin NOT NULL,
+  `resource_id` varchar(64) COLLATE utf8_bin NOT NULL,
+  `assignment_date` datetime NOT NULL,
+  PRIMARY KEY (`role_id`,`permission_id`,`resource_type`,`resource_id`),
+  KEY `resource` (`resource_type`,`resource_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+
+
+# Dump of table user_resource_permissions
+# Grants of a permission on a single resource straight to a user.
+# ------------------------------------------------------------
+
+CREATE TABLE `user_resource_permissions` (
+  `user_id` int(11) NOT NULL,
+  `permission_id` int(11) NOT NULL,
+  `resource_type` varchar(64) COLLATE utf8_bin NOT NULL,
+  `resource_id` varchar(64) COLLATE utf8_bin NOT NULL,
+  `assignment_date` datetime NOT NULL,
+  PRIMARY KEY (`user_id`,`permission_id`,`resource_type`,`resource_id`),
+  KEY `resource` (`resource_type`,`resource_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+
+
 # Dump of table roles
 # ------------------------------------------------------------
 
@@ -34,12 +89,16 @@ CREATE TABLE `roles` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `lft` int(11) NOT NULL,
   `rght` int(11) NOT NULL,
+  `parent_id` int(11) NOT NULL DEFAULT '0',
+  `depth` int(11) NOT NULL DEFAULT '0',
   `Title` varchar(128) CHARACTER SET utf8 NOT NULL,
   `description` text CHARACTER SET utf8 NOT NULL,
+  `max_members` int(11) NOT NULL DEFAULT '0',
   PRIMARY KEY (`id`),
   KEY `Title` (`Title`),
   KEY `lft` (`lft`),
-  KEY `rght` (`rght`)
+  KEY `rght` (`rght`),
+  KEY `parent_id` (`parent_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
 
 
@@ -50,6 +109,179 @@ CREATE TABLE `roles` (
 CREATE TABLE `user_roles` (
   `user_id` int(11) NOT NULL,
   `role_id` int(11) NOT NULL,
-  `assignment_date` int(11) NOT NULL,
+  `condition_expr` varchar(1024) COLLATE utf8_bin NOT NULL DEFAULT '',
+  `valid_from` datetime DEFAULT NULL,
+  `valid_until` datetime DEFAULT NULL,
+  `assignment_date` datetime NOT NULL,
   PRIMARY KEY (`user_id`,`role_id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+
+
+# Dump of table role_inheritance
+# Extra senior-junior edges on top of the role tree.
+# ------------------------------------------------------------
+
+CREATE TABLE `role_inheritance` (
+  `senior_id` int(11) NOT NULL,
+  `junior_id` int(11) NOT NULL,
+  PRIMARY KEY (`senior_id`,`junior_id`),
+  KEY `junior_id` (`junior_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+
+
+# Dump of table role_prerequisites
+# Roles a user must hold before being assigned role_id.
+# ------------------------------------------------------------
+
+CREATE TABLE `role_prerequisites` (
+  `role_id` int(11) NOT NULL,
+  `prerequisite_id` int(11) NOT NULL,
+  PRIMARY KEY (`role_id`,`prerequisite_id`),
+  KEY `prerequisite_id` (`prerequisite_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+
+
+# Dump of table ssd_constraints
+# Static separation of duty constraints: no user may hold cardinality or
+# more of the roles listed in ssd_constraint_roles.
+# ------------------------------------------------------------
+
+CREATE TABLE `ssd_constraints` (
+  `ID` int(11) NOT NULL AUTO_INCREMENT,
+  `name` varchar(128) COLLATE utf8_bin NOT NULL,
+  `cardinality` int(11) NOT NULL,
+  PRIMARY KEY (`ID`),
+  UNIQUE KEY `name` (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+CREATE TABLE `ssd_constraint_roles` (
+  `constraint_id` int(11) NOT NULL,
+  `role_id` int(11) NOT NULL,
+  PRIMARY KEY (`constraint_id`,`role_id`),
+  KEY `role_id` (`role_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+
+
+# Dump of table dsd_constraints
+# Dynamic separation of duty constraints: no session may activate
+# cardinality or more of the roles listed in dsd_constraint_roles.
+# ------------------------------------------------------------
+
+CREATE TABLE `dsd_constraints` (
+  `ID` int(11) NOT NULL AUTO_INCREMENT,
+  `name` varchar(128) COLLATE utf8_bin NOT NULL,
+  `cardinality` int(11) NOT NULL,
+  PRIMARY KEY (`ID`),
+  UNIQUE KEY `name` (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+CREATE TABLE `dsd_constraint_roles` (
+  `constraint_id` int(11) NOT NULL,
+  `role_id` int(11) NOT NULL,
+  PRIMARY KEY (`constraint_id`,`role_id`),
+  KEY `role_id` (`role_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+
+
+# Dump of table audit_log
+# Append-only record of every mutation. The triggers reject updates and deletes.
+# Every entry carries the SHA-256 hash chaining it to the entry before it.
+# ------------------------------------------------------------
+
+CREATE TABLE `audit_log` (
+  `ID` bigint(20) NOT NULL AUTO_INCREMENT,
+  `actor` varchar(255) COLLATE utf8_bin NOT NULL DEFAULT '',
+  `created_at` datetime(6) NOT NULL,
+  `kind` varchar(32) COLLATE utf8_bin NOT NULL,
+  `action` varchar(32) COLLATE utf8_bin NOT NULL,
+  `role_id` int(11) NOT NULL DEFAULT '0',
+  `permission_id` int(11) NOT NULL DEFAULT '0',
+  `owner` varchar(255) COLLATE utf8_bin NOT NULL DEFAULT '',
+  `before_value` text COLLATE utf8_bin,
+  `after_value` text COLLATE utf8_bin,
+  `prev_hash` char(64) COLLATE utf8_bin NOT NULL DEFAULT '',
+  `hash` char(64) COLLATE utf8_bin NOT NULL DEFAULT '',
+  PRIMARY KEY (`ID`),
+  KEY `actor` (`actor`),
+  KEY `created_at` (`created_at`),
+  KEY `role_id` (`role_id`),
+  KEY `permission_id` (`permission_id`),
+  KEY `owner` (`owner`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+CREATE TRIGGER `audit_log_no_update` BEFORE UPDATE ON `audit_log`
+  FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_log is append-only';
+
+CREATE TRIGGER `audit_log_no_delete` BEFORE DELETE ON `audit_log`
+  FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_log is append-only';
+
+
+
+# Dump of table audit_head
+# The first and latest entry of the audit chain. Writers lock this row to append.
+# ------------------------------------------------------------
+
+CREATE TABLE `audit_head` (
+  `ID` int(11) NOT NULL,
+  `first_entry_id` bigint(20) NOT NULL DEFAULT '0',
+  `entry_id` bigint(20) NOT NULL DEFAULT '0',
+  `hash` char(64) COLLATE utf8_bin NOT NULL DEFAULT '',
+  PRIMARY KEY (`ID`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+INSERT INTO `audit_head` (`ID`, `first_entry_id`, `entry_id`, `hash`) VALUES (1, 0, 0, '');
+
+
+
+# Dump of table audit_checkpoints
+# Ed25519 signatures over the head of the audit chain.
+# ------------------------------------------------------------
+
+CREATE TABLE `audit_checkpoints` (
+  `ID` bigint(20) NOT NULL AUTO_INCREMENT,
+  `entry_id` bigint(20) NOT NULL,
+  `hash` char(64) COLLATE utf8_bin NOT NULL,
+  `signature` char(128) COLLATE utf8_bin NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`ID`),
+  KEY `entry_id` (`entry_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+CREATE TRIGGER `audit_checkpoints_no_update` BEFORE UPDATE ON `audit_checkpoints`
+  FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_checkpoints is append-only';
+
+CREATE TRIGGER `audit_checkpoints_no_delete` BEFORE DELETE ON `audit_checkpoints`
+  FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_checkpoints is append-only';
+
+
+
+# Dump of table role_paths
+# Only used with the ClosureTable hierarchy.
+# ------------------------------------------------------------
+
+CREATE TABLE `role_paths` (
+  `ancestor_id` int(11) NOT NULL,
+  `descendant_id` int(11) NOT NULL,
+  `depth` int(11) NOT NULL,
+  PRIMARY KEY (`ancestor_id`,`descendant_id`),
+  KEY `descendant_id` (`descendant_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+
+
+# Dump of table permission_paths
+# Only used with the ClosureTable hierarchy.
+# ------------------------------------------------------------
+
+CREATE TABLE `permission_paths` (
+  `ancestor_id` int(11) NOT NULL,
+  `descendant_id` int(11) NOT NULL,
+  `depth` int(11) NOT NULL,
+  PRIMARY KEY (`ancestor_id`,`descendant_id`),
+  KEY `descendant_id` (`descendant_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
@@ -0,0 +1,40 @@
+# Adds parent pointers and depths to an existing role and permission tree.
+# The values are derived from the nested set, so run Verify first and
+# repair the nested set if it reports overlaps.
+# ------------------------------------------------------------
+
+ALTER TABLE `permissions`
+  ADD `parent_id` int(11) NOT NULL DEFAULT '0' AFTER `rght`,
+  ADD `depth` int(11) NOT NULL DEFAULT '0' AFTER `parent_id`,
+  ADD KEY `parent_id` (`parent_id`);
+
+UPDATE `permissions` AS node
+JOIN (
+  SELECT child.id,
+    (SELECT parent.id FROM `permissions` AS parent
+      WHERE parent.lft < child.lft AND parent.rght > child.rght
+      ORDER BY parent.lft DESC LIMIT 1) AS parent_id,
+    (SELECT COUNT(*) FROM `permissions` AS parent
+      WHERE parent.lft < child.lft AND parent.rght > child.rght) AS depth
+  FROM `permissions` AS child
+) AS derived ON (derived.id = node.id)
+SET node.parent_id = COALESCE(derived.parent_id, 0), node.depth = derived.depth;
+
+
+
+ALTER TABLE `roles`
+  ADD `parent_id` int(11) NOT NULL DEFAULT '0' AFTER `rght`,
+  ADD `depth` int(11) NOT NULL DEFAULT '0' AFTER `parent_id`,
+  ADD KEY `parent_id` (`parent_id`);
+
+UPDATE `roles` AS node
+JOIN (
+  SELECT child.id,
+    (SELECT parent.id FROM `roles` AS parent
+      WHERE parent.lft < child.lft AND parent.rght > child.rght
+      ORDER BY parent.lft DESC LIMIT 1) AS parent_id,
+    (SELECT COUNT(*) FROM `roles` AS parent
+      WHERE parent.lft < child.lft AND parent.rght > child.rght) AS depth
+  FROM `roles` AS child
+) AS derived ON (derived.id = node.id)
+SET node.parent_id = COALESCE(derived.parent_id, 0), node.depth = derived.depth;
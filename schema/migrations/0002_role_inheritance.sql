@@ -0,0 +1,10 @@
+# Adds extra senior-junior edges between roles, so a role can inherit from
+# more than one role besides its descendants in the tree.
+# ------------------------------------------------------------
+
+CREATE TABLE `role_inheritance` (
+  `senior_id` int(11) NOT NULL,
+  `junior_id` int(11) NOT NULL,
+  PRIMARY KEY (`senior_id`,`junior_id`),
+  KEY `junior_id` (`junior_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
@@ -0,0 +1,9 @@
+# Adds grants of wildcard permission paths such as /projects/*/read.
+# ------------------------------------------------------------
+
+CREATE TABLE `role_permission_patterns` (
+  `role_id` int(11) NOT NULL,
+  `pattern` varchar(255) COLLATE utf8_bin NOT NULL,
+  `assignment_date` int(11) NOT NULL,
+  PRIMARY KEY (`role_id`,`pattern`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
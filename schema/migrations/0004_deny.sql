@@ -0,0 +1,4 @@
+# Adds deny assignments. Existing grants stay allows.
+# ------------------------------------------------------------
+
+ALTER TABLE `role_permissions` ADD `deny` tinyint(1) NOT NULL DEFAULT '0' AFTER `permission_id`;
@@ -0,0 +1,22 @@
+# Adds permissions on single resources, granted to roles or to users.
+# ------------------------------------------------------------
+
+CREATE TABLE `role_resource_permissions` (
+  `role_id` int(11) NOT NULL,
+  `permission_id` int(11) NOT NULL,
+  `resource_type` varchar(64) COLLATE utf8_bin NOT NULL,
+  `resource_id` varchar(64) COLLATE utf8_bin NOT NULL,
+  `assignment_date` int(11) NOT NULL,
+  PRIMARY KEY (`role_id`,`permission_id`,`resource_type`,`resource_id`),
+  KEY `resource` (`resource_type`,`resource_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+CREATE TABLE `user_resource_permissions` (
+  `user_id` int(11) NOT NULL,
+  `permission_id` int(11) NOT NULL,
+  `resource_type` varchar(64) COLLATE utf8_bin NOT NULL,
+  `resource_id` varchar(64) COLLATE utf8_bin NOT NULL,
+  `assignment_date` int(11) NOT NULL,
+  PRIMARY KEY (`user_id`,`permission_id`,`resource_type`,`resource_id`),
+  KEY `resource` (`resource_type`,`resource_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
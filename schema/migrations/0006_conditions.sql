@@ -0,0 +1,7 @@
+# Adds condition expressions to role-permission and user-role assignments.
+# Existing assignments get an empty condition, which always holds.
+# ------------------------------------------------------------
+
+ALTER TABLE `role_permissions` ADD `condition_expr` varchar(1024) COLLATE utf8_bin NOT NULL DEFAULT '' AFTER `deny`;
+ALTER TABLE `role_permission_patterns` ADD `condition_expr` varchar(1024) COLLATE utf8_bin NOT NULL DEFAULT '' AFTER `pattern`;
+ALTER TABLE `user_roles` ADD `condition_expr` varchar(1024) COLLATE utf8_bin NOT NULL DEFAULT '' AFTER `role_id`;
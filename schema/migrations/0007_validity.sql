@@ -0,0 +1,11 @@
+# Stores assignment dates as timestamps and adds validity windows to
+# user-role and role-permission assignments.
+# The old assignment_date column only held the nanosecond part of the
+# assignment time, so existing rows are reset to the time of the migration.
+# ------------------------------------------------------------
+
+ALTER TABLE `role_permissions` DROP `assignment_date`, ADD `valid_from` datetime DEFAULT NULL AFTER `condition_expr`, ADD `valid_until` datetime DEFAULT NULL AFTER `valid_from`, ADD `assignment_date` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP AFTER `valid_until`;
+ALTER TABLE `role_permission_patterns` DROP `assignment_date`, ADD `valid_from` datetime DEFAULT NULL AFTER `condition_expr`, ADD `valid_until` datetime DEFAULT NULL AFTER `valid_from`, ADD `assignment_date` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP AFTER `valid_until`;
+ALTER TABLE `user_roles` DROP `assignment_date`, ADD `valid_from` datetime DEFAULT NULL AFTER `condition_expr`, ADD `valid_until` datetime DEFAULT NULL AFTER `valid_from`, ADD `assignment_date` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP AFTER `valid_until`;
+ALTER TABLE `role_resource_permissions` DROP `assignment_date`, ADD `assignment_date` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE `user_resource_permissions` DROP `assignment_date`, ADD `assignment_date` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP;
@@ -0,0 +1,18 @@
+# Adds dynamic separation of duty constraints, enforced when a session
+# activates a role.
+# ------------------------------------------------------------
+
+CREATE TABLE `dsd_constraints` (
+  `ID` int(11) NOT NULL AUTO_INCREMENT,
+  `name` varchar(128) COLLATE utf8_bin NOT NULL,
+  `cardinality` int(11) NOT NULL,
+  PRIMARY KEY (`ID`),
+  UNIQUE KEY `name` (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+CREATE TABLE `dsd_constraint_roles` (
+  `constraint_id` int(11) NOT NULL,
+  `role_id` int(11) NOT NULL,
+  PRIMARY KEY (`constraint_id`,`role_id`),
+  KEY `role_id` (`role_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
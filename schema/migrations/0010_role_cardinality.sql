@@ -0,0 +1,4 @@
+# Adds a maximum number of members to roles. 0 means unlimited.
+# ------------------------------------------------------------
+
+ALTER TABLE `roles` ADD `max_members` int(11) NOT NULL DEFAULT '0' AFTER `description`;
@@ -0,0 +1,10 @@
+# Adds prerequisite roles, which a user must hold before being assigned
+# the roles that require them.
+# ------------------------------------------------------------
+
+CREATE TABLE `role_prerequisites` (
+  `role_id` int(11) NOT NULL,
+  `prerequisite_id` int(11) NOT NULL,
+  PRIMARY KEY (`role_id`,`prerequisite_id`),
+  KEY `prerequisite_id` (`prerequisite_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
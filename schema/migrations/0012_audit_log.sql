@@ -0,0 +1,27 @@
+# Adds the append-only audit log.
+# ------------------------------------------------------------
+
+CREATE TABLE `audit_log` (
+  `ID` bigint(20) NOT NULL AUTO_INCREMENT,
+  `actor` varchar(255) COLLATE utf8_bin NOT NULL DEFAULT '',
+  `created_at` datetime(6) NOT NULL,
+  `kind` varchar(32) COLLATE utf8_bin NOT NULL,
+  `action` varchar(32) COLLATE utf8_bin NOT NULL,
+  `role_id` int(11) NOT NULL DEFAULT '0',
+  `permission_id` int(11) NOT NULL DEFAULT '0',
+  `owner` varchar(255) COLLATE utf8_bin NOT NULL DEFAULT '',
+  `before_value` text COLLATE utf8_bin,
+  `after_value` text COLLATE utf8_bin,
+  PRIMARY KEY (`ID`),
+  KEY `actor` (`actor`),
+  KEY `created_at` (`created_at`),
+  KEY `role_id` (`role_id`),
+  KEY `permission_id` (`permission_id`),
+  KEY `owner` (`owner`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+CREATE TRIGGER `audit_log_no_update` BEFORE UPDATE ON `audit_log`
+  FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_log is append-only';
+
+CREATE TRIGGER `audit_log_no_delete` BEFORE DELETE ON `audit_log`
+  FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_log is append-only';
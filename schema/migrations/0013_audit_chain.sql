@@ -0,0 +1,33 @@
+# Chains audit entries with SHA-256 hashes and adds signed checkpoints.
+# Entries recorded before this migration keep an empty hash; the chain
+# starts at the first entry written afterwards.
+# ------------------------------------------------------------
+
+ALTER TABLE `audit_log`
+  ADD `prev_hash` char(64) COLLATE utf8_bin NOT NULL DEFAULT '',
+  ADD `hash` char(64) COLLATE utf8_bin NOT NULL DEFAULT '';
+
+CREATE TABLE `audit_head` (
+  `ID` int(11) NOT NULL,
+  `entry_id` bigint(20) NOT NULL DEFAULT '0',
+  `hash` char(64) COLLATE utf8_bin NOT NULL DEFAULT '',
+  PRIMARY KEY (`ID`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+INSERT INTO `audit_head` (`ID`, `entry_id`, `hash`) VALUES (1, 0, '');
+
+CREATE TABLE `audit_checkpoints` (
+  `ID` bigint(20) NOT NULL AUTO_INCREMENT,
+  `entry_id` bigint(20) NOT NULL,
+  `hash` char(64) COLLATE utf8_bin NOT NULL,
+  `signature` char(128) COLLATE utf8_bin NOT NULL,
+  `created_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`ID`),
+  KEY `entry_id` (`entry_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_bin;
+
+CREATE TRIGGER `audit_checkpoints_no_update` BEFORE UPDATE ON `audit_checkpoints`
+  FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_checkpoints is append-only';
+
+CREATE TRIGGER `audit_checkpoints_no_delete` BEFORE DELETE ON `audit_checkpoints`
+  FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_checkpoints is append-only';
@@ -0,0 +1,10 @@
+# Records where the audit chain starts, so that Verify can flag unhashed
+# entries inserted after it.
+# ------------------------------------------------------------
+
+ALTER TABLE `audit_head`
+  ADD `first_entry_id` bigint(20) NOT NULL DEFAULT '0' AFTER `ID`;
+
+UPDATE `audit_head`
+  SET `first_entry_id` = (SELECT COALESCE(MIN(`ID`), 0) FROM `audit_log` WHERE `hash` <> '')
+  WHERE `ID` = 1;
@@ -0,0 +1,407 @@
+package gorbac
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSessionNotFound   = errors.New("session not found")
+	ErrSessionConflict   = errors.New("session was changed by another call")
+	ErrRoleNotAuthorized = errors.New("role is not assigned to the session user")
+)
+
+// DefaultSessionTTL is how long a MemorySessionStore created by
+// NewMemorySessionStore keeps a session that is not used.
+const DefaultSessionTTL = 24 * time.Hour
+
+// SessionData is what a SessionStore keeps for a session. Version is
+// the number of times the session has been saved.
+type SessionData struct {
+	ID      string
+	User    UserInterface
+	Roles   []int64
+	Created time.Time
+	Version int64
+}
+
+// SessionStore keeps sessions between calls. Get returns ErrSessionNotFound
+// for an unknown ID. Save is a compare-and-swap: it stores session only when
+// the stored version still equals session.Version, or when a new session
+// with Version 0 does not exist yet, and increments the stored version.
+// Otherwise it returns ErrSessionConflict. Implementations must be safe for
+// concurrent use.
+type SessionStore interface {
+	Save(session SessionData) error
+	Get(id string) (SessionData, error)
+	Delete(id string) error
+}
+
+// MemorySessionStore keeps sessions in memory. It is the default store, and
+// its sessions are lost when the process exits. Sessions that are not used
+// for longer than the store's TTL expire and are evicted.
+type MemorySessionStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	sessions  map[string]memorySession
+	nextSweep time.Time
+}
+
+type memorySession struct {
+	data    SessionData
+	expires time.Time
+}
+
+// NewMemorySessionStore returns a store whose sessions expire after
+// DefaultSessionTTL without use.
+func NewMemorySessionStore() *MemorySessionStore {
+	return NewMemorySessionStoreTTL(DefaultSessionTTL)
+}
+
+// NewMemorySessionStoreTTL returns a store whose sessions expire after ttl
+// without use.
+func NewMemorySessionStoreTTL(ttl time.Duration) *MemorySessionStore {
+	return &MemorySessionStore{ttl: ttl, sessions: make(map[string]memorySession)}
+}
+
+func (m *MemorySessionStore) Save(session SessionData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var now = time.Now()
+	m.sweep(now)
+
+	stored, ok := m.get(session.ID, now)
+	if (ok && stored.Version != session.Version) || (!ok && session.Version != 0) {
+		return ErrSessionConflict
+	}
+
+	session.Roles = append([]int64(nil), session.Roles...)
+	session.Version++
+	m.sessions[session.ID] = memorySession{data: session, expires: now.Add(m.ttl)}
+	return nil
+}
+
+func (m *MemorySessionStore) Get(id string) (SessionData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var now = time.Now()
+	session, ok := m.get(id, now)
+	if !ok {
+		return SessionData{}, ErrSessionNotFound
+	}
+	m.sessions[id] = memorySession{data: session, expires: now.Add(m.ttl)}
+
+	session.Roles = append([]int64(nil), session.Roles...)
+	return session, nil
+}
+
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+// get returns a session that has not expired, and evicts it if it has.
+func (m *MemorySessionStore) get(id string, now time.Time) (SessionData, bool) {
+	session, ok := m.sessions[id]
+	if !ok {
+		return SessionData{}, false
+	}
+	if !now.Before(session.expires) {
+		delete(m.sessions, id)
+		return SessionData{}, false
+	}
+	return session.data, true
+}
+
+// sweep evicts every expired session, at most once per TTL.
+func (m *MemorySessionStore) sweep(now time.Time) {
+	if now.Before(m.nextSweep) {
+		return
+	}
+	for id, session := range m.sessions {
+		if !now.Before(session.expires) {
+			delete(m.sessions, id)
+		}
+	}
+	m.nextSweep = now.Add(m.ttl)
+}
+
+// DSDViolation describes a role activation that breaks a dynamic separation
+// of duty constraint.
+type DSDViolation struct {
+	Constraint  string
+	Cardinality int
+	Session     string
+	Roles       []string
+}
+
+func (v *DSDViolation) Error() string {
+	return fmt.Sprintf("%v: session %s would activate %s, but constraint %q allows fewer than %d of its roles at once",
+		ErrDSDViolation, v.Session, strings.Join(v.Roles, ", "), v.Constraint, v.Cardinality)
+}
+
+func (v *DSDViolation) Unwrap() error {
+	return ErrDSDViolation
+}
+
+// Session is a user working with a subset of their roles. Checks made
+// through a session only consider the roles activated in it.
+type Session struct {
+	rbac *Rbac
+	id   string
+	user UserInterface
+}
+
+// CreateSession starts a session for user without any active roles.
+func (r Rbac) CreateSession(user UserInterface) (*Session, error) {
+	if err := checkUser(user); err != nil {
+		return nil, err
+	}
+
+	var id = make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	var data = SessionData{ID: hex.EncodeToString(id), User: user, Created: time.Now().UTC()}
+	if err := r.sessions.Save(data); err != nil {
+		return nil, err
+	}
+
+	return &Session{rbac: &r, id: data.ID, user: user}, nil
+}
+
+// Session resumes a session created by CreateSession.
+func (r Rbac) Session(id string) (*Session, error) {
+	data, err := r.sessions.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{rbac: &r, id: data.ID, user: data.User}, nil
+}
+
+func (s *Session) ID() string {
+	return s.id
+}
+
+func (s *Session) User() UserInterface {
+	return s.user
+}
+
+// ActiveRoles returns the roles activated in the session.
+func (s *Session) ActiveRoles() ([]Role, error) {
+	data, err := s.rbac.sessions.Get(s.id)
+	if err != nil || len(data.Roles) == 0 {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("SELECT ID, Title, Description FROM roles WHERE ID IN (%s) ORDER BY ID", placeholders(len(data.Roles)))
+	rows, err := s.rbac.db.Query(query, int64Args(data.Roles)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.Title, &role.Description); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+// ActivateRole adds a role the user holds, directly or through inheritance,
+// to the session. Assignment conditions are evaluated when checking, not
+// here. It fails with a *DSDViolation when the session's active roles would
+// break a dynamic separation of duty constraint.
+func (s *Session) ActivateRole(role RoleInterface) error {
+	roleID, err := s.rbac.roles.GetRoleID(role)
+	if err != nil {
+		return err
+	}
+
+	authorized, err := s.authorizedRoles()
+	if err != nil {
+		return err
+	}
+	if !containsID(authorized, roleID) {
+		return ErrRoleNotAuthorized
+	}
+
+	constraints, err := s.rbac.Constraints().load(dsdTables)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(data *SessionData) (bool, error) {
+		if containsID(data.Roles, roleID) {
+			return false, nil
+		}
+
+		if len(constraints) > 0 {
+			before, err := s.rbac.Constraints().evaluate(constraints, s.user, data.Roles)
+			if err != nil {
+				return false, err
+			}
+			after, err := s.rbac.Constraints().evaluate(constraints, s.user, append(data.Roles, roleID))
+			if err != nil {
+				return false, err
+			}
+			if err := newViolation(before, after); err != nil {
+				v := err.(*SSDViolation)
+				return false, &DSDViolation{Constraint: v.Constraint, Cardinality: v.Cardinality, Session: s.id, Roles: v.Roles}
+			}
+		}
+
+		data.Roles = append(data.Roles, roleID)
+		sort.Slice(data.Roles, func(i, j int) bool { return data.Roles[i] < data.Roles[j] })
+		return true, nil
+	})
+}
+
+// DropRole deactivates a role in the session.
+func (s *Session) DropRole(role RoleInterface) error {
+	roleID, err := s.rbac.roles.GetRoleID(role)
+	if err != nil {
+		return err
+	}
+
+	return s.update(func(data *SessionData) (bool, error) {
+		var roles []int64
+		for _, id := range data.Roles {
+			if id != roleID {
+				roles = append(roles, id)
+			}
+		}
+		changed := len(roles) != len(data.Roles)
+		data.Roles = roles
+		return changed, nil
+	})
+}
+
+// update applies change to the stored session and saves it when change
+// reports a change. When another call saved the session in the meantime,
+// change is applied again to the newer version, so concurrent activations
+// are checked against each other's roles.
+func (s *Session) update(change func(data *SessionData) (bool, error)) error {
+	for {
+		data, err := s.rbac.sessions.Get(s.id)
+		if err != nil {
+			return err
+		}
+
+		changed, err := change(&data)
+		if err != nil || !changed {
+			return err
+		}
+
+		err = s.rbac.sessions.Save(data)
+		if err != ErrSessionConflict {
+			return err
+		}
+	}
+}
+
+// Check checks whether the roles active in the session grant a permission.
+func (s *Session) Check(permission PermissionInterface) (bool, error) {
+	return s.CheckWithAttributes(permission, nil)
+}
+
+// CheckWithAttributes is Check with assignment and grant conditions
+// evaluated against attrs. Active roles whose assignment to the user has
+// since been removed, has expired or whose condition does not hold are ignored.
+func (s *Session) CheckWithAttributes(permission PermissionInterface, attrs Attributes) (bool, error) {
+	permissionID, err := s.rbac.permissions.GetPermissionID(permission)
+	if err != nil {
+		return false, err
+	}
+
+	data, err := s.rbac.sessions.Get(s.id)
+	if err != nil {
+		return false, err
+	}
+
+	assigned, err := s.rbac.ownerRoles("user_roles", s.user, attrs)
+	if err != nil {
+		return false, err
+	}
+	if len(assigned) == 0 {
+		return false, nil
+	}
+
+	authorized, err := s.rbac.roles.expand(assigned)
+	if err != nil {
+		return false, err
+	}
+
+	var active []int64
+	for _, id := range data.Roles {
+		if containsID(authorized, id) {
+			active = append(active, id)
+		}
+	}
+	if len(active) == 0 {
+		return false, nil
+	}
+
+	roleID, err := s.rbac.permitted(active, permissionID, attrs)
+	return roleID != 0, err
+}
+
+// Close ends the session.
+func (s *Session) Close() error {
+	return s.rbac.sessions.Delete(s.id)
+}
+
+// authorizedRoles returns every role the user can activate, which is every
+// role reachable from their active assignments, regardless of conditions.
+func (s *Session) authorizedRoles() ([]int64, error) {
+	query := fmt.Sprintf("SELECT role_id FROM user_roles AS TRel WHERE user_id=? AND %s", active("TRel"))
+	rows, err := s.rbac.db.Query(query, append([]interface{}{s.user}, activeArgs()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roleIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		roleIDs = append(roleIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(roleIDs) == 0 {
+		return nil, nil
+	}
+
+	return s.rbac.roles.expand(roleIDs)
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package gorbac
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySessionStoreConflict(t *testing.T) {
+	store := NewMemorySessionStore()
+	assert.Nil(t, store.Save(SessionData{ID: "a", User: int64(1)}))
+	assert.Equal(t, ErrSessionConflict, store.Save(SessionData{ID: "a", User: int64(1)}))
+
+	first, err := store.Get("a")
+	assert.Nil(t, err)
+	second, err := store.Get("a")
+	assert.Nil(t, err)
+
+	first.Roles = []int64{2}
+	assert.Nil(t, store.Save(first))
+
+	second.Roles = []int64{3}
+	assert.Equal(t, ErrSessionConflict, store.Save(second))
+
+	stored, err := store.Get("a")
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2}, stored.Roles)
+	assert.Equal(t, int64(2), stored.Version)
+}
+
+func TestMemorySessionStoreExpiry(t *testing.T) {
+	store := NewMemorySessionStoreTTL(10 * time.Millisecond)
+	assert.Nil(t, store.Save(SessionData{ID: "a"}))
+	assert.Nil(t, store.Save(SessionData{ID: "b"}))
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, err := store.Get("a")
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	assert.Nil(t, store.Save(SessionData{ID: "c"}))
+	assert.Equal(t, 1, len(store.sessions))
+}
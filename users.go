@@ -1,7 +1,6 @@
 package gorbac
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"log"
@@ -13,6 +12,10 @@ type UserInterface interface{}
 
 type Owner interface{}
 
+// Owners stores the role assignments of one kind of owner. Table names the
+// table that holds them, which needs a user_id column with the owner and a
+// role_id column with the role: member limits, exports and user counts read
+// it directly.
 type Owners interface {
 	Assign(role RoleInterface, owner Owner, meta interface{}) (int64, error)
 	HasRole(role RoleInterface, owner Owner) (bool, error)
@@ -37,15 +40,36 @@ func newUsers(r *Rbac) Users {
 	return users
 }
 
+// Bind returns a copy of u that runs its queries through rbac.
+func (u Users) Bind(rbac *Rbac) Owners {
+	return Users{rbac: rbac, table: u.table}
+}
+
 func (u Users) Table() string {
 	return u.table
 }
 
-// Assigns a role to a user
-func (u Users) Assign(role RoleInterface, userID Owner, _ interface{}) (int64, error) {
+// Assigns a role to a user. meta can be a Condition, which limits the
+// assignment to checks whose attributes satisfy it, or AssignmentOptions,
+// which can also limit it to a validity window; any other meta fails with
+// ErrInvalidMeta. A conditional assignment only counts for
+// Rbac.CheckWithAttributes: Check and HasRole have no attributes and ignore
+// it. The assignment fails with an *SSDViolation when it would break a
+// separation of duty constraint, with a *PrerequisiteError when the user
+// lacks a prerequisite role, and with ErrRoleFull when the role already has
+// its maximum number of members.
+func (u Users) Assign(role RoleInterface, userID Owner, meta interface{}) (int64, error) {
 	var err error
 	var roleID int64
 
+	options, err := assignmentOptions(meta)
+	if err != nil {
+		return 0, err
+	}
+	if err = options.validate(); err != nil {
+		return 0, err
+	}
+
 	if _, ok := userID.(string); ok {
 		if userID.(string) == "" {
 			return 0, ErrUserRequired
@@ -73,14 +97,38 @@ func (u Users) Assign(role RoleInterface, userID Owner, _ interface{}) (int64, e
 	}
 
 	if roleID > 0 {
-		var query = fmt.Sprintf("INSERT INTO %s (user_id, role_id, assignment_date) VALUES(?,?,?)", u.getTable())
-		res, err := u.rbac.db.Exec(query, userID, roleID, time.Now().Nanosecond())
+		var insertID int64
+		err = u.rbac.audited(KindOwner, ActionAssign, func(tx *Rbac, record *auditRecord) error {
+			if err := tx.reserveMember(roleID); err != nil {
+				return err
+			}
+			if err := tx.Constraints().checkAssign(u.getTable(), userID, roleID); err != nil {
+				return err
+			}
+			if err := (Users{rbac: tx, table: u.table}).checkPrerequisites(roleID, userID); err != nil {
+				return err
+			}
+
+			var query = fmt.Sprintf("INSERT INTO %s (user_id, role_id, condition_expr, valid_from, valid_until, assignment_date) VALUES(?,?,?,?,?,?)", u.getTable())
+			res, err := tx.db.Exec(query, userID, roleID, options.Condition, nullTime(options.ValidFrom), nullTime(options.ValidUntil), time.Now().UTC())
+			if err != nil {
+				return err
+			}
+
+			insertID, _ = res.LastInsertId()
+
+			state, err := tx.auditRole(roleID)
+			if err != nil {
+				return err
+			}
+			state.options(options)
+			record.roleID, record.owner, record.after = roleID, userID, state
+			return nil
+		})
 		if err != nil {
 			return 0, err
 		}
 
-		insertID, _ := res.LastInsertId()
-
 		return insertID, nil
 	}
 
@@ -88,45 +136,53 @@ func (u Users) Assign(role RoleInterface, userID Owner, _ interface{}) (int64, e
 }
 
 // Checks to see whether a UserInterface has a Role or not.
+// Assignments that carry a condition are ignored, as there are no attributes
+// to evaluate it against.
 func (u Users) HasRole(role RoleInterface, userID Owner) (bool, error) {
+	var start = time.Now()
+	assignedID, err := u.holdingRole(role, userID)
+
+	var decision = Decision{Operation: DecisionHasRole, User: fmt.Sprint(userID), Role: fmt.Sprint(role)}
+	u.rbac.logDecision(decision, start, assignedID != 0, err, assignedID)
+
+	return assignedID != 0, err
+}
+
+// hasRole is HasRole without decision logging, for internal checks.
+func (u Users) hasRole(role RoleInterface, userID Owner) (bool, error) {
+	assignedID, err := u.holdingRole(role, userID)
+	return assignedID != 0, err
+}
+
+// holdingRole returns the role assigned to userID that covers role, or 0
+// when the user does not hold it.
+func (u Users) holdingRole(role RoleInterface, userID Owner) (int64, error) {
 	if _, ok := userID.(string); ok {
 		if userID.(string) == "" {
-			return false, ErrUserRequired
+			return 0, ErrUserRequired
 		}
 	} else if _, ok := userID.(int64); ok {
 		if userID.(int64) == 0 {
-			return false, ErrUserRequired
+			return 0, ErrUserRequired
 		}
 	}
 
 	roleID, err := u.rbac.Roles().GetRoleID(role)
 	if err != nil {
-		return false, err
+		return 0, err
 	}
 
-	query := fmt.Sprintf(`
-	SELECT COUNT(*) FROM user_roles AS TUR
-	JOIN roles AS TRdirect ON (TRdirect.ID=TUR.role_id)
-	JOIN roles AS TR ON (TR.Lft BETWEEN TRdirect.Lft AND TRdirect.Rght)
-	WHERE
-	TUR.user_id=? AND TR.ID=?`)
-
-	var result int64
-	err = u.rbac.db.QueryRow(query, userID, roleID).Scan(&result)
+	roleIDs, err := u.rbac.ownerRoles(u.getTable(), userID, nil)
 	if err != nil {
-		if err != sql.ErrNoRows {
-			return false, err
-		}
-	}
-
-	if result > 0 {
-		return true, nil
+		return 0, err
 	}
 
-	return false, nil
+	return u.rbac.roles.covering(roleIDs, roleID)
 }
 
 // Unassigns a Role from a User interface.
+// Roles that required the revoked role are revoked as well, or the
+// revocation fails with a *PrerequisiteError, depending on Config.Revocation.
 func (u Users) Unassign(role RoleInterface, userID Owner) error {
 	if _, ok := userID.(string); ok {
 		if userID.(string) == "" {
@@ -143,15 +199,32 @@ func (u Users) Unassign(role RoleInterface, userID Owner) error {
 		return err
 	}
 
-	_, err = u.rbac.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id=? AND role_id=?", u.getTable()), userID, roleID)
-	if err != nil {
-		return err
-	}
+	return u.rbac.audited(KindOwner, ActionUnassign, func(tx *Rbac, record *auditRecord) error {
+		state, err := tx.auditRole(roleID)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		found, err := tx.lockAssignment(&state, fmt.Sprintf("SELECT FALSE, condition_expr, valid_from, valid_until FROM %s WHERE user_id=? AND role_id=?", u.getTable()), userID, roleID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			record.skip = true
+			return nil
+		}
+		record.roleID, record.owner, record.before = roleID, userID, state
+
+		_, err = tx.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id=? AND role_id=?", u.getTable()), userID, roleID)
+		if err != nil {
+			return err
+		}
+
+		return Users{rbac: tx, table: u.table}.revokeDependents(userID, roleID)
+	})
 }
 
-// Returns all Roles of a User.
+// Returns all active Roles of a User.
 func (u Users) AllRoles(userID Owner, _ interface{}) ([]Role, error) {
 	if _, ok := userID.(string); ok {
 		if userID.(string) == "" {
@@ -170,9 +243,9 @@ func (u Users) AllRoles(userID Owner, _ interface{}) ([]Role, error) {
 			%s AS TRel
 		JOIN roles AS TR ON
 		(TRel.role_id=TR.ID)
-		WHERE TRel.user_id=?`, u.getTable())
+		WHERE TRel.user_id=? AND %s`, u.getTable(), active("TRel"))
 
-	rows, err := u.rbac.db.Query(query, userID)
+	rows, err := u.rbac.db.Query(query, append([]interface{}{userID}, activeArgs()...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -226,10 +299,13 @@ func (u Users) ResetAssignments(ensure bool) error {
 	if err != nil {
 		return err
 	}
-	_, err = u.rbac.db.Exec("ALTER TABLE user_roles AUTO_INCREMENT =1")
+	_, err = u.rbac.db.Exec("DELETE FROM user_resource_permissions")
 	if err != nil {
 		return err
 	}
+	if err = u.rbac.record(KindOwner, ActionReset, auditRecord{}); err != nil {
+		return err
+	}
 
 	u.Assign("root", u.rbac.rootID(), nil)
 
@@ -0,0 +1,209 @@
+package gorbac
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrInvalidValidity is returned when an assignment would expire before it starts.
+var ErrInvalidValidity = errors.New("valid until must be after valid from")
+
+// ErrInvalidMeta is returned when the meta argument of Owners.Assign is not
+// nil, a Condition or AssignmentOptions.
+var ErrInvalidMeta = errors.New("assignment meta must be a Condition or AssignmentOptions")
+
+// AssignmentOptions qualify a user-role or role-permission assignment.
+// Outside of its validity window an assignment is ignored, as if it did not
+// exist. A zero ValidFrom means the assignment applies right away, a zero
+// ValidUntil means it never expires.
+type AssignmentOptions struct {
+	Condition  Condition
+	ValidFrom  time.Time
+	ValidUntil time.Time
+}
+
+func (o AssignmentOptions) validate() error {
+	if !o.ValidFrom.IsZero() && !o.ValidUntil.IsZero() && !o.ValidUntil.After(o.ValidFrom) {
+		return ErrInvalidValidity
+	}
+	return o.Condition.Validate()
+}
+
+// assignmentOptions reads the meta argument of Owners.Assign, which can be
+// nil, a Condition or AssignmentOptions. A plain string is rejected rather
+// than taken for a condition, so a typed Condition is always deliberate.
+func assignmentOptions(meta interface{}) (AssignmentOptions, error) {
+	switch m := meta.(type) {
+	case nil:
+		return AssignmentOptions{}, nil
+	case Condition:
+		return AssignmentOptions{Condition: m}, nil
+	case AssignmentOptions:
+		return m, nil
+	case *AssignmentOptions:
+		if m != nil {
+			return *m, nil
+		}
+		return AssignmentOptions{}, nil
+	}
+	return AssignmentOptions{}, fmt.Errorf("%w, not %T", ErrInvalidMeta, meta)
+}
+
+// nullTime stores the zero time as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// active returns an SQL condition that holds for rows of the aliased table
+// whose validity window contains the time passed twice as argument.
+func active(alias string) string {
+	return fmt.Sprintf("(%s.valid_from IS NULL OR %s.valid_from <= ?) AND (%s.valid_until IS NULL OR %s.valid_until > ?)", alias, alias, alias, alias)
+}
+
+func activeArgs() []interface{} {
+	now := time.Now().UTC()
+	return []interface{}{now, now}
+}
+
+// PurgeExpired deletes every owner-role and role-permission assignment whose
+// validity has ended, and returns how many were deleted. Owner assignments are
+// purged from the table of every registered Users extension. Every deleted
+// assignment is recorded in the audit log as unassigned.
+func (r Rbac) PurgeExpired() (int64, error) {
+	type purge struct {
+		kind    ChangeKind
+		table   string
+		columns string
+	}
+
+	var purges = []purge{
+		{KindGrant, "role_permissions", "role_id, permission_id, '', deny"},
+		{KindGrant, "role_permission_patterns", "role_id, 0, pattern, FALSE"},
+	}
+	var seen = make(map[string]bool)
+	for _, extension := range r.extensions {
+		if users, ok := extension.(Users); ok && !seen[users.getTable()] {
+			seen[users.getTable()] = true
+			purges = append(purges, purge{KindOwner, users.getTable(), "role_id, 0, user_id, FALSE"})
+		}
+	}
+
+	var total int64
+	err := r.transaction(func(tx *Rbac) error {
+		var now = time.Now().UTC()
+		for _, p := range purges {
+			records, err := tx.expiredRecords(p.kind, fmt.Sprintf("SELECT %s, condition_expr, valid_from, valid_until FROM %s WHERE valid_until IS NOT NULL AND valid_until <= ? FOR UPDATE", p.columns, p.table), now)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE valid_until IS NOT NULL AND valid_until <= ?", p.table), now); err != nil {
+				return err
+			}
+
+			for _, record := range records {
+				if err := tx.record(p.kind, ActionUnassign, record); err != nil {
+					return err
+				}
+			}
+			total += int64(len(records))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// expiredRecords reads the audit records of the assignments selected by
+// query, which returns the role, the permission ID, the pattern or owner,
+// the deny flag, the condition and the validity window of each.
+func (r Rbac) expiredRecords(kind ChangeKind, query string, args ...interface{}) ([]auditRecord, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type row struct {
+		roleID, permissionID int64
+		other                string
+		deny                 bool
+		options              AssignmentOptions
+	}
+
+	var found []row
+	for rows.Next() {
+		var f row
+		var from, until sql.NullTime
+		if err := rows.Scan(&f.roleID, &f.permissionID, &f.other, &f.deny, &f.options.Condition, &from, &until); err != nil {
+			return nil, err
+		}
+		f.options.ValidFrom, f.options.ValidUntil = from.Time, until.Time
+		found = append(found, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	var records []auditRecord
+	for _, f := range found {
+		var record = auditRecord{roleID: f.roleID}
+		var state auditAssignment
+		var err error
+		if kind == KindOwner {
+			record.owner = f.other
+			state, err = r.auditRole(f.roleID)
+		} else {
+			var permission PermissionInterface = f.permissionID
+			if f.other != "" {
+				permission = f.other
+			}
+			record.permissionID = f.permissionID
+			state, err = r.auditGrant(f.roleID, f.permissionID, permission)
+		}
+		if err != nil {
+			return nil, err
+		}
+		state.Deny = f.deny
+		state.options(f.options)
+		record.before = state
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// StartSweeper runs PurgeExpired every interval until the returned function
+// is called. Errors are logged and do not stop the sweeper.
+func (r Rbac) StartSweeper(interval time.Duration) (stop func()) {
+	var done = make(chan struct{})
+	var ticker = time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := r.PurgeExpired(); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}